@@ -0,0 +1,46 @@
+package ptrguard
+
+// ArgsBuilder assembles a list of pointer and scalar arguments for a C call,
+// e.g. for a wrapper of a variadic C function, that receives its arguments as
+// an array. All pointer arguments are pinned until `Release()` is called, so
+// the list can be passed to C even though it contains Go pointers. The zero
+// value is ready to use.
+type ArgsBuilder struct {
+	pinner Pinner
+	args   []uintptr
+}
+
+// AddPtr pins the Go object referenced by pointer and appends the pointer to
+// the arguments. The pointer must be a pointer of any type or unsafe.Pointer,
+// otherwise AddPtr() panics.
+func (b *ArgsBuilder) AddPtr(pointer interface{}) *ArgsBuilder {
+	b.args = append(b.args, uintptr(b.pinner.Pin(pointer).ptr))
+	return b
+}
+
+// AddInt appends the integer i to the arguments.
+func (b *ArgsBuilder) AddInt(i int) *ArgsBuilder {
+	b.args = append(b.args, uintptr(i))
+	return b
+}
+
+// AddUintptr appends the uintptr u to the arguments.
+func (b *ArgsBuilder) AddUintptr(u uintptr) *ArgsBuilder {
+	b.args = append(b.args, u)
+	return b
+}
+
+// Args returns the arguments added so far, with pointers converted to
+// uintptr. Since the slice doesn't contain Go pointers in the eyes of the
+// runtime, a pointer to its first element can be passed to C. It is only valid
+// until `Release()` is called.
+func (b *ArgsBuilder) Args() []uintptr {
+	return b.args
+}
+
+// Release unpins all pointer arguments and resets the builder, so that it can
+// be reused.
+func (b *ArgsBuilder) Release() {
+	b.args = nil
+	b.pinner.Unpin()
+}
@@ -0,0 +1,30 @@
+//go:build cgo
+// +build cgo
+
+package ptrguard_test
+
+import (
+	"testing"
+
+	"github.com/ansiwen/ptrguard"
+	. "github.com/ansiwen/ptrguard/internal/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArgsBuilder(t *testing.T) {
+	buf1 := []byte{1, 2, 3}
+	buf2 := []byte{10, 20}
+	var b ptrguard.ArgsBuilder
+	defer b.Release()
+	b.AddPtr(&buf1[0]).AddInt(len(buf1))
+	b.AddPtr(&buf2[0]).AddUintptr(uintptr(len(buf2)))
+	assert.Len(t, b.Args(), 4)
+	assert.Equal(t, 36, SumBytesArgs(b.Args()))
+	b.Release()
+	assert.Empty(t, b.Args())
+	assert.Panics(t,
+		func() {
+			b.AddPtr(buf1)
+		},
+	)
+}
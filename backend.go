@@ -0,0 +1,112 @@
+package ptrguard
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Backend is a strategy of how the pinned objects of a Pinner are kept alive.
+// All backends provide the same semantics, they only differ in their costs.
+type Backend int
+
+const (
+	// BackendQueue keeps all pinned objects of a Pinner in a single background
+	// go routine.
+	BackendQueue Backend = iota
+	// BackendGoroutine keeps each pinned object in its own background go
+	// routine.
+	BackendGoroutine
+	// BackendRuntime pins the objects with runtime.Pinner, which doesn't need
+	// any go routines. It is only available, if the package is built with Go
+	// 1.21 or later.
+	BackendRuntime
+	// BackendPool keeps each pinned object in its own background go routine
+	// like BackendGoroutine, but the go routines are recycled with a pool, which
+	// avoids creating new ones, when objects are pinned and unpinned frequently.
+	// Up to 256 idle go routines stay parked in the pool.
+	BackendPool
+)
+
+func (b Backend) String() string {
+	switch b {
+	case BackendQueue:
+		return "queue"
+	case BackendGoroutine:
+		return "goroutine"
+	case BackendRuntime:
+		return "runtime"
+	case BackendPool:
+		return "pool"
+	}
+	return fmt.Sprintf("Backend(%d)", int(b))
+}
+
+// keeper keeps the pinned objects of a Pinner reachable for the garbage
+// collector, until they are released.
+type keeper interface {
+	// pin keeps ptr reachable, until it is released.
+	pin(ptr unsafe.Pointer)
+	// release releases a single pin of ptr.
+	release(ptr unsafe.Pointer)
+	// releaseAll releases all pins and returns, when they are released.
+	releaseAll()
+}
+
+// batchKeeper is implemented by keepers, that can pin several pointers at once
+// more efficiently than one by one, e.g. for PinAll().
+type batchKeeper interface {
+	// pinBatch keeps all ptrs reachable, until they are released. The ptrs
+	// are distinct and not pinned yet.
+	pinBatch(ptrs []unsafe.Pointer)
+}
+
+// newKeeper contains the constructors of the available backends.
+var newKeeper = availableKeepers()
+
+func availableKeepers() map[Backend]func() keeper {
+	keepers := map[Backend]func() keeper{
+		BackendQueue:     newQueueKeeper,
+		BackendGoroutine: newGoroutineKeeper,
+		BackendPool:      newPoolKeeper,
+	}
+	if newRuntimeKeeper != nil {
+		keepers[BackendRuntime] = newRuntimeKeeper
+	}
+	return keepers
+}
+
+// backendPreference lists the backends from the cheapest to the most expensive
+// one.
+var backendPreference = []Backend{
+	BackendRuntime, BackendQueue, BackendPool, BackendGoroutine,
+}
+
+// backend is the Backend used for new pins. It is accessed atomically, since
+// SetBackend() may be called concurrently with Pinners pinning objects.
+var backend = int32(cheapestBackend())
+
+func cheapestBackend() Backend {
+	for _, b := range backendPreference {
+		if _, ok := newKeeper[b]; ok {
+			return b
+		}
+	}
+	panic("ptrguard: no backend available")
+}
+
+// SetBackend sets the backend, that is used by Pinners for the objects pinned
+// after their next `Unpin()`, or by new Pinners. By default the cheapest backend
+// available for the running Go version is used. SetBackend() panics, if b is
+// not available.
+func SetBackend(b Backend) {
+	if _, ok := newKeeper[b]; !ok {
+		panic(fmt.Sprintf("ptrguard: backend %s is not available", b))
+	}
+	atomic.StoreInt32(&backend, int32(b))
+}
+
+// CurrentBackend returns the backend, that is used for new pins.
+func CurrentBackend() Backend {
+	return Backend(atomic.LoadInt32(&backend))
+}
@@ -0,0 +1,177 @@
+package ptrguard
+
+import (
+	"context"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"unsafe"
+)
+
+// queueKeeper keeps all pinned objects of a Pinner in a single go routine, so
+// pinning many objects doesn't create a go routine for each of them. The
+// objects are held in a slice of unsafe.Pointer instead of the uintptr
+// arguments of a //go:uintptrescapes function, because the compiler only keeps
+// the objects of an explicit argument list alive, and not those of a slice
+// passed with "...", so the set of such a call can't grow without restarting
+// the go routine for every Pin().
+type queueKeeper struct {
+	pins chan pinOp    // sends requests to the pinning go routine
+	done chan struct{} // closed when the pinning go routine exits
+}
+
+func newQueueKeeper() keeper {
+	k := &queueKeeper{
+		pins: make(chan pinOp),
+		done: make(chan struct{}),
+	}
+	// Start a background go routine that lives until Unpin() is called. It
+	// collects all pinned pointers of the Pinner, so that the garbage
+	// collector doesn't touch them, and exits when it receives the "release"
+	// signal. In debug mode it is labeled with their addresses.
+	goPinUntilRelease(k.pins, k.done, debug)
+	return k
+}
+
+func (k *queueKeeper) pin(ptr unsafe.Pointer) {
+	// Since the channel is unbuffered, the go routine owns ptr when the send
+	// completes.
+	k.pins <- pinOp{ptr: ptr}
+}
+
+func (k *queueKeeper) release(ptr unsafe.Pointer) {
+	k.pins <- pinOp{ptr: ptr, release: true}
+}
+
+func (k *queueKeeper) releaseAll() {
+	close(k.pins) // send "release" to the pinning go routine
+	<-k.done      // wait for all pinned pointers to be released
+}
+
+type goroutineKeeper struct {
+	pins []goroutinePin
+	wg   sync.WaitGroup
+	pool bool // recycle the go routines with a pool
+}
+
+type goroutinePin struct {
+	ptr     unsafe.Pointer
+	release chan struct{}
+	// number of unreleased pins sharing the go routine of a batch, or nil
+	batch *int
+}
+
+// done releases the pin. The go routine of a batch is only released with the
+// last pin of the batch, so the other objects stay pinned meanwhile.
+func (pin goroutinePin) done() {
+	if pin.batch != nil {
+		*pin.batch--
+		if *pin.batch > 0 {
+			return
+		}
+	}
+	close(pin.release)
+}
+
+// pinBatchSize is the maximal number of pointers, that are kept alive by a
+// single go routine in pinBatch().
+const pinBatchSize = 8
+
+func newGoroutineKeeper() keeper {
+	return &goroutineKeeper{}
+}
+
+func (k *goroutineKeeper) pin(ptr unsafe.Pointer) {
+	release := make(chan struct{})
+	addrs := pinAddrs(ptr)
+	k.wg.Add(1)
+	if k.pool {
+		poolPin(poolJob{ptr, release, &k.wg, addrs})
+		k.pins = append(k.pins, goroutinePin{ptr: ptr, release: release})
+		return
+	}
+	// The go routine references ptr from its creation on, until it receives
+	// the "release" signal.
+	go pprof.Do(context.Background(), pinAddrLabels(addrs), func(context.Context) {
+		<-release
+		runtime.KeepAlive(ptr)
+		k.wg.Done()
+	})
+	k.pins = append(k.pins, goroutinePin{ptr: ptr, release: release})
+}
+
+// pinBatch pins the ptrs with a go routine for each pinBatchSize of them,
+// instead of one for each pointer. With the pool, they are pinned one by one.
+func (k *goroutineKeeper) pinBatch(ptrs []unsafe.Pointer) {
+	if k.pool {
+		for _, ptr := range ptrs {
+			k.pin(ptr)
+		}
+		return
+	}
+	for len(ptrs) > 0 {
+		n := len(ptrs)
+		if n > pinBatchSize {
+			n = pinBatchSize
+		}
+		k.pinChunk(ptrs[:n])
+		ptrs = ptrs[n:]
+	}
+}
+
+func (k *goroutineKeeper) pinChunk(ptrs []unsafe.Pointer) {
+	var p [pinBatchSize]unsafe.Pointer
+	copy(p[:], ptrs)
+	release := make(chan struct{})
+	remaining := len(ptrs)
+	k.wg.Add(1)
+	go pinChunkWorker(release, &k.wg, pinAddrs(ptrs...), p)
+	for _, ptr := range ptrs {
+		k.pins = append(k.pins, goroutinePin{ptr: ptr, release: release, batch: &remaining})
+	}
+}
+
+// pinChunkWorker keeps the objects of p alive, until release is closed. The
+// array is passed by value and not used after pinUntilReleaseN() is called, so
+// the objects are only kept alive by the call.
+func pinChunkWorker(release <-chan struct{}, wg *sync.WaitGroup, addrs string,
+	p [pinBatchSize]unsafe.Pointer,
+) {
+	setPinLabels(addrs)
+	pinUntilReleaseN(release, uintptr(p[0]), uintptr(p[1]), uintptr(p[2]),
+		uintptr(p[3]), uintptr(p[4]), uintptr(p[5]), uintptr(p[6]), uintptr(p[7]))
+	wg.Done()
+}
+
+// pinUntilReleaseN blocks until release is closed. Since the ptrs are converted
+// from pointers in the argument list of the call, the compiler keeps all of the
+// objects alive until pinUntilReleaseN() returns, also for a variadic argument.
+// The argument list must be explicit for this, a slice passed with "..." is not
+// covered.
+//
+//go:uintptrescapes
+//go:noinline
+func pinUntilReleaseN(release <-chan struct{}, ptrs ...uintptr) {
+	<-release
+}
+
+func (k *goroutineKeeper) release(ptr unsafe.Pointer) {
+	for i := range k.pins {
+		if k.pins[i].ptr == ptr {
+			k.pins[i].done()
+			last := len(k.pins) - 1
+			copy(k.pins[i:], k.pins[i+1:])
+			k.pins[last] = goroutinePin{}
+			k.pins = k.pins[:last]
+			return
+		}
+	}
+}
+
+func (k *goroutineKeeper) releaseAll() {
+	for _, pin := range k.pins {
+		pin.done()
+	}
+	k.pins = nil
+	k.wg.Wait()
+}
@@ -0,0 +1,49 @@
+package ptrguard // nolint:testpackage
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinChunkWorker(t *testing.T) {
+	var finalized [pinBatchSize]int32
+	var p [pinBatchSize]unsafe.Pointer
+	for i := range p {
+		i := i
+		obj := new([64]byte)
+		runtime.SetFinalizer(obj, func(*[64]byte) {
+			atomic.StoreInt32(&finalized[i], 1)
+		})
+		p[i] = unsafe.Pointer(obj)
+	}
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go pinChunkWorker(release, &wg, "", p)
+	p = [pinBatchSize]unsafe.Pointer{}
+	// The objects are only kept alive by the arguments of pinUntilReleaseN().
+	runtime.GC()
+	runtime.GC()
+	time.Sleep(10 * time.Millisecond)
+	for i := range finalized {
+		assert.Zero(t, atomic.LoadInt32(&finalized[i]), i)
+	}
+	close(release)
+	wg.Wait()
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool {
+		for i := range finalized {
+			if atomic.LoadInt32(&finalized[i]) == 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,7 @@
+//go:build !go1.21
+// +build !go1.21
+
+package ptrguard
+
+// runtime.Pinner is not available before Go 1.21.
+var newRuntimeKeeper func() keeper
@@ -0,0 +1,94 @@
+package ptrguard
+
+import (
+	"context"
+	"runtime/pprof"
+	"sync"
+	"unsafe"
+)
+
+// maxIdlePoolWorkers is the maximal number of parked go routines, that wait in
+// the pool for the next pointer to pin. Workers beyond that exit after their
+// pointer has been released.
+const maxIdlePoolWorkers = 256
+
+// poolJob is a request to a pool worker to keep ptr alive, until release is
+// closed, and then to call done.Done(). In debug mode addrs contains the
+// address of ptr for the labels of the worker, see pinAddrs().
+type poolJob struct {
+	ptr     unsafe.Pointer
+	release <-chan struct{}
+	done    *sync.WaitGroup
+	addrs   string
+}
+
+var (
+	poolMtx sync.Mutex
+	// job channels of the idle workers
+	idlePoolWorkers []chan poolJob
+)
+
+func newPoolKeeper() keeper {
+	return &goroutineKeeper{pool: true}
+}
+
+// poolPin hands job over to an idle pool worker, or starts a new one, if there
+// is none.
+func poolPin(job poolJob) {
+	poolMtx.Lock()
+	if n := len(idlePoolWorkers); n > 0 {
+		jobs := idlePoolWorkers[n-1]
+		idlePoolWorkers[n-1] = nil
+		idlePoolWorkers = idlePoolWorkers[:n-1]
+		poolMtx.Unlock()
+		jobs <- job
+		return
+	}
+	poolMtx.Unlock()
+	jobs := make(chan poolJob, 1)
+	jobs <- job
+	go pprof.Do(context.Background(), pinLabels, func(context.Context) {
+		poolWorker(jobs)
+	})
+}
+
+// poolWorker keeps the pointers of the jobs it receives alive, one at a time,
+// and parks in the pool in between, so that it can be recycled for the next
+// pin.
+func poolWorker(jobs chan poolJob) {
+	for {
+		job := <-jobs
+		ptr, release, done, addrs := job.ptr, job.release, job.done, job.addrs
+		job = poolJob{}
+		if addrs != "" {
+			setPinLabels(addrs)
+		}
+		holdUntil(uintptr(ptr), release)
+		if addrs != "" {
+			setPinLabels("")
+		}
+		// The worker is parked before the release is reported, so that it can
+		// be reused as soon as `Unpin()` returns.
+		poolMtx.Lock()
+		parked := len(idlePoolWorkers) < maxIdlePoolWorkers
+		if parked {
+			idlePoolWorkers = append(idlePoolWorkers, jobs)
+		}
+		poolMtx.Unlock()
+		done.Done()
+		if !parked {
+			return
+		}
+	}
+}
+
+// holdUntil blocks until release is closed. Since p is converted from a pointer
+// in the argument list of the call, the compiler keeps the object alive until
+// holdUntil() returns. This way a recycled worker doesn't keep any reference to
+// its previous pointer.
+//
+//go:uintptrescapes
+//go:noinline
+func holdUntil(p uintptr, release <-chan struct{}) {
+	<-release
+}
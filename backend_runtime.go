@@ -0,0 +1,42 @@
+//go:build go1.21
+// +build go1.21
+
+package ptrguard
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+var newRuntimeKeeper = func() keeper {
+	return &runtimeKeeper{}
+}
+
+// runtimeKeeper pins the objects with a runtime.Pinner. Since it can only
+// unpin all objects at once, the pinned pointers are tracked, so that the
+// remaining ones can be pinned again after a single one is released.
+type runtimeKeeper struct {
+	pinner runtime.Pinner
+	ptrs   []unsafe.Pointer
+}
+
+func (k *runtimeKeeper) pin(ptr unsafe.Pointer) {
+	trackRuntimePin(ptr)
+	k.pinner.Pin(ptr)
+	k.ptrs = append(k.ptrs, ptr)
+}
+
+func (k *runtimeKeeper) release(ptr unsafe.Pointer) {
+	k.ptrs = removePointer(k.ptrs, ptr)
+	k.pinner.Unpin()
+	untrackRuntimePins(ptr)
+	for _, ptr := range k.ptrs {
+		k.pinner.Pin(ptr)
+	}
+}
+
+func (k *runtimeKeeper) releaseAll() {
+	k.pinner.Unpin()
+	untrackRuntimePins(k.ptrs...)
+	k.ptrs = nil
+}
@@ -0,0 +1,11 @@
+//go:build go1.21 && cgo
+// +build go1.21,cgo
+
+package ptrguard_test
+
+import "github.com/ansiwen/ptrguard"
+
+func init() {
+	allBackends = append(allBackends, ptrguard.BackendRuntime)
+	defaultBackend = ptrguard.BackendRuntime
+}
@@ -0,0 +1,266 @@
+//go:build cgo
+// +build cgo
+
+package ptrguard_test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ansiwen/ptrguard"
+	"github.com/stretchr/testify/assert"
+)
+
+var allBackends = []ptrguard.Backend{
+	ptrguard.BackendQueue,
+	ptrguard.BackendGoroutine,
+	ptrguard.BackendPool,
+}
+
+// defaultBackend is the backend that is expected to be selected by default.
+var defaultBackend = ptrguard.BackendQueue
+
+// withBackend runs f with the backend b and restores the previous one
+// afterwards.
+func withBackend(b ptrguard.Backend, f func()) {
+	old := ptrguard.CurrentBackend()
+	defer ptrguard.SetBackend(old)
+	ptrguard.SetBackend(b)
+	f()
+}
+
+func TestBackends(t *testing.T) {
+	assert.Equal(t, defaultBackend, ptrguard.CurrentBackend())
+	assert.Panics(t, func() { ptrguard.SetBackend(ptrguard.Backend(-1)) })
+	assert.Equal(t, defaultBackend, ptrguard.CurrentBackend())
+	for _, b := range allBackends {
+		t.Run(b.String(), func(t *testing.T) {
+			withBackend(b, func() {
+				assert.Equal(t, b, ptrguard.CurrentBackend())
+				TestPin(t)
+				TestReusePinner(t)
+				TestMultiStore(t)
+				TestMultiPin(t)
+				TestPinBytes(t)
+				TestSwap(t)
+				TestForEachPinned(t)
+				TestPins(t)
+				TestPinnedUnpin(t)
+				TestMerge(t)
+			})
+		})
+	}
+}
+
+func TestSetBackendConcurrent(t *testing.T) {
+	old := ptrguard.CurrentBackend()
+	defer ptrguard.SetBackend(old)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			ptrguard.SetBackend(allBackends[i%len(allBackends)])
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		var pg ptrguard.Pinner
+		pg.Pin(new(int))
+		pg.Unpin()
+	}
+	<-done
+}
+
+func TestBackendGoroutines(t *testing.T) {
+	const pins = 16
+	expected := map[ptrguard.Backend]int{
+		ptrguard.BackendQueue:     1,
+		ptrguard.BackendGoroutine: pins,
+		ptrguard.BackendRuntime:   0,
+	}
+	for _, b := range allBackends {
+		// The go routines of the pool stay parked, see TestBackendPool.
+		if b == ptrguard.BackendPool {
+			continue
+		}
+		withBackend(b, func() {
+			n := runtime.NumGoroutine()
+			var pg ptrguard.Pinner
+			for i := 0; i < pins; i++ {
+				pg.Pin(new(int))
+			}
+			assert.Equal(t, n+expected[b], runtime.NumGoroutine(), b)
+			pg.Unpin()
+			// The condition of assert.Eventually() runs in its own go routine.
+			assert.Eventually(t, func() bool { return runtime.NumGoroutine() == n+1 },
+				5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+// BenchmarkMultiPin pins 1024 objects with each backend and reports the number
+// of parked go routines. BackendQueue shows the reduction to a single go
+// routine per Pinner, which replaces a growing //go:uintptrescapes call, that
+// can't keep the objects of a slice alive (see queueKeeper).
+func BenchmarkMultiPin(b *testing.B) {
+	const pins = 1024
+	for _, backend := range allBackends {
+		b.Run(backend.String(), func(b *testing.B) {
+			withBackend(backend, func() {
+				var goroutines int
+				for i := 0; i < b.N; i++ {
+					n := runtime.NumGoroutine()
+					var pg ptrguard.Pinner
+					for j := 0; j < pins; j++ {
+						pg.Pin(new(int))
+					}
+					goroutines = runtime.NumGoroutine() - n
+					pg.Unpin()
+				}
+				b.ReportMetric(float64(goroutines), "goroutines")
+			})
+		})
+	}
+}
+
+func TestBackendSharedPins(t *testing.T) {
+	const pins = 16
+	expected := map[ptrguard.Backend]int{
+		ptrguard.BackendQueue:     1,
+		ptrguard.BackendGoroutine: 1,
+		ptrguard.BackendRuntime:   0,
+	}
+	for _, b := range allBackends {
+		if b == ptrguard.BackendPool {
+			continue
+		}
+		withBackend(b, func() {
+			n := runtime.NumGoroutine()
+			var pg ptrguard.Pinner
+			ptr := new(int)
+			pinned := make([]*ptrguard.Pinned, pins)
+			for i := range pinned {
+				pinned[i] = pg.Pin(ptr)
+			}
+			assert.Equal(t, n+expected[b], runtime.NumGoroutine(), b)
+			assert.Equal(t, pins, pg.Len(), b)
+			for _, pp := range pinned[1:] {
+				pp.Unpin()
+			}
+			assert.Equal(t, n+expected[b], runtime.NumGoroutine(), b)
+			pg.Unpin()
+			assert.Eventually(t, func() bool { return runtime.NumGoroutine() == n+1 },
+				5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+// stableGoroutines returns the number of go routines, as soon as it hasn't
+// changed for a while, e.g. after go routines of previous tests have exited.
+func stableGoroutines() int {
+	n := runtime.NumGoroutine()
+	for stable := 0; stable < 10; stable++ {
+		time.Sleep(time.Millisecond)
+		if m := runtime.NumGoroutine(); m != n {
+			n = m
+			stable = 0
+		}
+	}
+	return n
+}
+
+// waitGoroutines waits until there are at most n go routines and reports
+// whether that has happened within 5 seconds. Unlike with assert.Eventually(),
+// no additional go routine is involved.
+func waitGoroutines(n int) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if runtime.NumGoroutine() <= n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestBackendPinBatch(t *testing.T) {
+	const pins = 12
+	withBackend(ptrguard.BackendGoroutine, func() {
+		trs := make([]tracer, pins)
+		ptrs := make([]interface{}, pins)
+		for i := range trs {
+			trs[i] = newTracer()
+			ptrs[i] = trs[i].p
+			trs[i].p = nil
+		}
+		n := stableGoroutines()
+		var pg ptrguard.Pinner
+		pinned := pg.PinAll(ptrs...)
+		ptrs = nil
+		// A go routine for each batch of up to 8 pointers.
+		assert.Equal(t, n+2, runtime.NumGoroutine())
+		assert.Equal(t, pins, pg.Len())
+		// Objects of a batch stay pinned, until the whole batch is released.
+		pinned[0].Unpin()
+		pinned = nil
+		runtime.GC()
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		for i := range trs {
+			assert.False(t, trs[i].finalized(), i)
+		}
+		assert.Equal(t, n+2, runtime.NumGoroutine())
+		pg.Unpin()
+		runtime.GC()
+		runtime.GC()
+		assert.Eventually(t, func() bool {
+			for i := range trs {
+				if !trs[i].finalized() {
+					return false
+				}
+			}
+			return true
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.True(t, waitGoroutines(n))
+	})
+}
+
+func TestBackendPool(t *testing.T) {
+	const pins = 16
+	withBackend(ptrguard.BackendPool, func() {
+		var pg ptrguard.Pinner
+		for i := 0; i < pins; i++ {
+			pg.Pin(new(int))
+		}
+		pg.Unpin()
+		// All go routines are parked in the pool now, and are recycled.
+		n := runtime.NumGoroutine()
+		for i := 0; i < pins; i++ {
+			pg.Pin(new(int))
+		}
+		assert.Equal(t, n, runtime.NumGoroutine())
+		pg.Unpin()
+		assert.Equal(t, n, runtime.NumGoroutine())
+	})
+}
+
+// BenchmarkPinChurn pins and unpins 16 objects with the go routine based
+// backends.
+func BenchmarkPinChurn(b *testing.B) {
+	const pins = 16
+	for _, backend := range []ptrguard.Backend{
+		ptrguard.BackendGoroutine, ptrguard.BackendPool,
+	} {
+		b.Run(backend.String(), func(b *testing.B) {
+			withBackend(backend, func() {
+				var pg ptrguard.Pinner
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					for j := 0; j < pins; j++ {
+						pg.Pin(new(int))
+					}
+					pg.Unpin()
+				}
+			})
+		})
+	}
+}
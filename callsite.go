@@ -0,0 +1,113 @@
+package ptrguard
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+var (
+	validateCallSites bool
+	debug             bool
+)
+
+// SetCallSiteValidation enables or disables the call site validation mode. In
+// this mode the calling function of each Pin() is recorded, and `Unpin()`
+// reports pins that have been created in a different function than the one
+// calling `Unpin()`, which usually means that a Pinner is passed around more
+// than intended. The check is only advisory, since there are legitimate uses
+// for this, and the reports are printed to stderr. It should be enabled before
+// any Pinner is used, and has no overhead when disabled, which is the default.
+func SetCallSiteValidation(enabled bool) {
+	validateCallSites = enabled
+}
+
+// SetDebug enables or disables the debug mode. In this mode the call stack of
+// each Pin() is recorded, and the *LeakError of a leaked Pinner contains the
+// call stacks of all its pins, so that the pins, that are missing an `Unpin()`,
+// can be found. The pinning go routines of the backends are additionally
+// labeled with the addresses of their objects as "ptrguard-addr" in goroutine
+// profiles. It should be enabled before any Pinner is used, and has no
+// overhead when disabled, which is the default.
+func SetDebug(enabled bool) {
+	debug = enabled
+}
+
+// callers returns the program counters of the call stack of the caller of the
+// calling function.
+func callers() []uintptr {
+	pcs := make([]uintptr, 32)
+	return pcs[:runtime.Callers(3, pcs)]
+}
+
+// formatStacks formats the call stacks given by program counters like in a
+// panic: each frame is described by its function and location in two lines.
+func formatStacks(stacks [][]uintptr) []string {
+	formatted := make([]string, 0, len(stacks))
+	for _, pcs := range stacks {
+		var b strings.Builder
+		frames := runtime.CallersFrames(pcs)
+		for {
+			frame, more := frames.Next()
+			fmt.Fprintf(&b, "%s()\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+			if !more {
+				break
+			}
+		}
+		formatted = append(formatted, b.String())
+	}
+	return formatted
+}
+
+// stacks returns the call stacks of the current pins, that have been recorded
+// in debug mode.
+func (d *data) stacks() [][]uintptr {
+	var stacks [][]uintptr
+	for _, pin := range d.pins {
+		if pin.stack != nil {
+			stacks = append(stacks, pin.stack)
+		}
+	}
+	return stacks
+}
+
+// callSite returns the first frame on the call stack, that is not part of this
+// package (apart from its tests) or the runtime, or an empty frame.
+func callSite() runtime.Frame {
+	var pcs [32]uintptr
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs[:])])
+	for {
+		frame, more := frames.Next()
+		internal := strings.HasPrefix(frame.Function, "runtime.") ||
+			strings.HasPrefix(frame.Function, "github.com/ansiwen/ptrguard.") &&
+				!strings.HasSuffix(frame.File, "_test.go")
+		if !internal {
+			return frame
+		}
+		if !more {
+			return runtime.Frame{}
+		}
+	}
+}
+
+func (d *data) checkCallSites(unpinSite string) {
+	if unpinSite == "" {
+		return
+	}
+	reported := map[string]bool{unpinSite: true}
+	for _, pin := range d.pins {
+		pinSite := pin.site
+		if pinSite != "" && !reported[pinSite] {
+			reported[pinSite] = true
+			callSiteMismatch(pinSite, unpinSite)
+		}
+	}
+}
+
+// To be able to test the call site validation, this report function is a
+// variable, that can be overwritten by a test.
+var callSiteMismatch = func(pinSite, unpinSite string) {
+	fmt.Fprintf(os.Stderr, "ptrguard: Pin() in %s is released by Unpin() "+
+		"in %s\n", pinSite, unpinSite)
+}
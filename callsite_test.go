@@ -0,0 +1,34 @@
+package ptrguard // nolint:testpackage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pinElsewhere(pg *Pinner) {
+	pg.PinBytes([]byte("fooBar"))
+}
+
+func TestCallSiteValidation(t *testing.T) {
+	var reports [][2]string
+	defer func(f func(string, string)) { callSiteMismatch = f }(callSiteMismatch)
+	callSiteMismatch = func(pinSite, unpinSite string) {
+		reports = append(reports, [2]string{pinSite, unpinSite})
+	}
+	SetCallSiteValidation(true)
+	defer SetCallSiteValidation(false)
+	var pg Pinner
+	pg.Pin(&[1]byte{})
+	pg.PinBytes([]byte("fooBar"))
+	pg.Unpin()
+	assert.Empty(t, reports)
+	pg.Pin(&[1]byte{})
+	pinElsewhere(&pg)
+	pinElsewhere(&pg)
+	pg.Unpin()
+	assert.Equal(t, [][2]string{{
+		"github.com/ansiwen/ptrguard.pinElsewhere",
+		"github.com/ansiwen/ptrguard.TestCallSiteValidation",
+	}}, reports)
+}
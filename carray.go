@@ -0,0 +1,47 @@
+package ptrguard
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// CPtrArray is a bounds checked view on a C array of pointers, e.g. a `void**`
+// or `char**` allocated with malloc.
+type CPtrArray struct {
+	base   unsafe.Pointer
+	length int
+}
+
+// NewCPtrArray returns a CPtrArray for the C array of length pointers at base.
+// It panics if length is negative, or if base is nil or not properly aligned
+// for a non-empty array.
+func NewCPtrArray(base unsafe.Pointer, length int) *CPtrArray {
+	switch {
+	case length < 0:
+		panic(fmt.Sprintf("ptrguard: negative C array length %d", length))
+	case length == 0:
+	case base == nil:
+		panic("ptrguard: C array base is nil")
+	case uintptr(base)%unsafe.Alignof(base) != 0:
+		panic(fmt.Sprintf("ptrguard: C array base %p is not aligned to %d bytes",
+			base, unsafe.Alignof(base)))
+	}
+	return &CPtrArray{base: base, length: length}
+}
+
+// Len returns the number of elements of the array.
+func (a *CPtrArray) Len() int {
+	return a.length
+}
+
+// Set stores the pinned pointer p in the element i of the array. Like with
+// Store(), the element is zeroed by `Unpin()` of the Pinner, that pinned p. If
+// i is out of range, Set() panics.
+func (a *CPtrArray) Set(i int, p *Pinned) {
+	if i < 0 || i >= a.length {
+		panic(fmt.Sprintf("ptrguard: C array index %d out of range [0:%d]",
+			i, a.length))
+	}
+	p.StorePointer((*unsafe.Pointer)(unsafe.Pointer(uintptr(a.base) +
+		uintptr(i)*unsafe.Sizeof(a.base))))
+}
@@ -0,0 +1,34 @@
+//go:build go1.18
+// +build go1.18
+
+package ptrguard
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// CArraySlice returns a slice of length and capacity n on top of a C array of
+// n elements of type T at base, e.g. allocated with malloc, which allows easier
+// and bounds checked access to its elements. It panics if base is not properly
+// aligned for T, if n is negative, or if the array would exceed the address
+// space. For n == 0 it returns nil.
+func CArraySlice[T any](base unsafe.Pointer, n int) []T {
+	var zero T
+	size, align := unsafe.Sizeof(zero), unsafe.Alignof(zero)
+	switch {
+	case n < 0:
+		panic(fmt.Sprintf("ptrguard: negative C array length %d", n))
+	case n == 0:
+		return nil
+	case base == nil:
+		panic("ptrguard: C array base is nil")
+	case uintptr(base)%align != 0:
+		panic(fmt.Sprintf("ptrguard: C array base %p is not aligned to %d bytes",
+			base, align))
+	case size != 0 && uintptr(n) > (^uintptr(0)-uintptr(base))/size:
+		panic(fmt.Sprintf("ptrguard: C array of %d elements of %d bytes at %p "+
+			"exceeds the address space", n, size, base))
+	}
+	return unsafe.Slice((*T)(base), n)
+}
@@ -0,0 +1,52 @@
+//go:build go1.18 && cgo
+// +build go1.18,cgo
+
+package ptrguard_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/ansiwen/ptrguard"
+	C "github.com/ansiwen/ptrguard/internal/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCArraySlice(t *testing.T) {
+	const n = 4
+	cPtr := C.Malloc(C.SizeOfIovec * n)
+	defer C.Free(cPtr)
+	iovec := ptrguard.CArraySlice[C.Iovec](cPtr, n)
+	assert.Len(t, iovec, n)
+	assert.Equal(t, n, cap(iovec))
+	assert.Equal(t, cPtr, unsafe.Pointer(&iovec[0]))
+	assert.Equal(t, uintptr(cPtr)+C.SizeOfIovec*(n-1),
+		uintptr(unsafe.Pointer(&iovec[n-1])))
+	assert.Panics(t, func() { _ = iovec[n] })
+
+	buffers := make([][]byte, n)
+	var pinner ptrguard.Pinner
+	for i := range iovec {
+		buffers[i] = make([]byte, i+1)
+		pinner.PinBytes(buffers[i]).Store(&iovec[i].Base)
+		iovec[i].Len = C.Int(len(buffers[i]))
+	}
+	C.FillBuffersWithX(&iovec[0], len(iovec))
+	pinner.Unpin()
+	for i := range buffers {
+		for _, b := range buffers[i] {
+			assert.Equal(t, byte('X'), b)
+		}
+		assert.Zero(t, iovec[i].Base)
+	}
+
+	assert.Nil(t, ptrguard.CArraySlice[C.Iovec](nil, 0))
+	assert.Panics(t, func() { ptrguard.CArraySlice[C.Iovec](cPtr, -1) })
+	assert.Panics(t, func() { ptrguard.CArraySlice[C.Iovec](nil, 1) })
+	assert.Panics(t, func() {
+		ptrguard.CArraySlice[C.Iovec](unsafe.Pointer(uintptr(cPtr)+1), 1)
+	})
+	assert.Panics(t, func() {
+		ptrguard.CArraySlice[C.Iovec](cPtr, int(^uint(0)>>1))
+	})
+}
@@ -0,0 +1,70 @@
+//go:build cgo && !ptrguard_nolinkname
+// +build cgo,!ptrguard_nolinkname
+
+package ptrguard
+
+import (
+	"sync"
+)
+
+var (
+	cgocheckMtx sync.Mutex
+	cgocheckCnt uint
+	cgocheckOld int32
+)
+
+// CgoCheckLevel returns the current level of the cgocheck of the runtime: 0 if
+// it is disabled, e.g. inside of NoCheck(), 1 for the cheap checks of the
+// arguments of C calls, and 2 for the expensive checks of all stores of Go
+// pointers. Only in case of 1 or 2 NoCheck() is needed to pass Go memory
+// containing pinned Go pointers to C. Since Go 1.21 level 2 can't be enabled
+// with GODEBUG=cgocheck=2 anymore, but only with GOEXPERIMENT=cgocheck2 at
+// build time, which is taken into account as well. If the debug variable of the
+// runtime can't be found, the level is unknown and -1 is returned, like with the
+// build tag ptrguard_nolinkname.
+func CgoCheckLevel() int {
+	if cgocheck == nil {
+		return -1
+	}
+	cgocheckMtx.Lock()
+	defer cgocheckMtx.Unlock()
+	return cgocheckLevel(*cgocheck)
+}
+
+func cgocheckOff() {
+	if cgocheck == nil {
+		return
+	}
+	cgocheckMtx.Lock()
+	if cgocheckCnt == 0 {
+		cgocheckOld = *cgocheck
+		*cgocheck = 0
+	}
+	cgocheckCnt++
+	cgocheckMtx.Unlock()
+}
+
+func cgocheckOn() {
+	if cgocheck == nil {
+		return
+	}
+	cgocheckMtx.Lock()
+	cgocheckCnt--
+	if cgocheckCnt == 0 {
+		*cgocheck = cgocheckOld
+	}
+	cgocheckMtx.Unlock()
+}
+
+// lockCgoCheck locks the cgocheck setting, so that it can't be changed by
+// NoCheck() until unlockCgoCheck() is called, and reports whether cgocheck is
+// enabled. If the debug variable of the runtime can't be found, cgocheck is
+// reported as disabled, since its state is unknown.
+func lockCgoCheck() bool {
+	cgocheckMtx.Lock()
+	return cgocheck != nil && *cgocheck != 0
+}
+
+func unlockCgoCheck() {
+	cgocheckMtx.Unlock()
+}
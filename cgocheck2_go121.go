@@ -0,0 +1,13 @@
+//go:build cgo && go1.21 && goexperiment.cgocheck2
+// +build cgo,go1.21,goexperiment.cgocheck2
+
+package ptrguard
+
+// With GOEXPERIMENT=cgocheck2 the runtime performs the expensive checks as
+// well, as long as the debug variable doesn't disable cgocheck.
+func cgocheckLevel(v int32) int {
+	if v == 0 {
+		return 0
+	}
+	return 2
+}
@@ -0,0 +1,9 @@
+//go:build cgo && !go1.21
+// +build cgo,!go1.21
+
+package ptrguard
+
+// Before Go 1.21 the debug variable contains the level as set by GODEBUG.
+func cgocheckLevel(v int32) int {
+	return int(v)
+}
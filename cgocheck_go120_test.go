@@ -0,0 +1,8 @@
+//go:build cgo && !go1.21
+// +build cgo,!go1.21
+
+package ptrguard_test
+
+// Before Go 1.21 CgoCheckLevel() reports the level of GODEBUG=cgocheck
+// unchanged.
+const godebugCgoCheckExact = true
@@ -0,0 +1,13 @@
+//go:build cgo && go1.21 && !goexperiment.cgocheck2
+// +build cgo,go1.21,!goexperiment.cgocheck2
+
+package ptrguard
+
+// Since Go 1.21 the debug variable only enables or disables the checks of the
+// arguments of C calls.
+func cgocheckLevel(v int32) int {
+	if v == 0 {
+		return 0
+	}
+	return 1
+}
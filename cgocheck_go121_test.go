@@ -0,0 +1,8 @@
+//go:build cgo && go1.21
+// +build cgo,go1.21
+
+package ptrguard_test
+
+// Since Go 1.21 GODEBUG=cgocheck=2 doesn't enable the expensive checks anymore,
+// so CgoCheckLevel() doesn't necessarily report the level of GODEBUG.
+const godebugCgoCheckExact = false
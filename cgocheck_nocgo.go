@@ -0,0 +1,16 @@
+//go:build !cgo
+// +build !cgo
+
+package ptrguard
+
+// Without cgo there are no C calls that could be checked.
+
+// CgoCheckLevel returns the current level of the cgocheck of the runtime, which
+// is always 0 without cgo.
+func CgoCheckLevel() int {
+	return 0
+}
+
+func cgocheckOff() {}
+
+func cgocheckOn() {}
@@ -0,0 +1,29 @@
+//go:build cgo && ptrguard_nolinkname
+// +build cgo,ptrguard_nolinkname
+
+package ptrguard
+
+// With the build tag ptrguard_nolinkname the debug variables of the runtime are
+// not accessed with go:linkname, e.g. for toolchains, that forbid it. Then
+// cgocheck can't be disabled by this package, and the checks of the arguments of
+// C calls must be avoided by shadowing the cgocheck call, as described for
+// NoCheck().
+
+// CgoCheckLevel returns the current level of the cgocheck of the runtime, which
+// is unknown with the build tag ptrguard_nolinkname, so it always returns -1.
+func CgoCheckLevel() int {
+	return -1
+}
+
+func cgocheckOff() {}
+
+func cgocheckOn() {}
+
+// lockCgoCheck always reports cgocheck as disabled, since its state is unknown,
+// so that the foreign pointer check, which depends on cgocheck, is not
+// performed.
+func lockCgoCheck() bool {
+	return false
+}
+
+func unlockCgoCheck() {}
@@ -0,0 +1,40 @@
+//go:build cgo && ptrguard_nolinkname
+// +build cgo,ptrguard_nolinkname
+
+package ptrguard_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/ansiwen/ptrguard"
+	C "github.com/ansiwen/ptrguard/internal/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoLinkname(t *testing.T) {
+	assert.Equal(t, -1, ptrguard.CgoCheckLevel())
+	called := false
+	ptrguard.NoCheck(func() { called = true })
+	assert.True(t, called)
+	assert.Equal(t, -1, ptrguard.CgoCheckLevel())
+
+	// The runtime backend pins with runtime.Pinner, which is accepted by
+	// cgocheck, but the other backends depend on disabling cgocheck.
+	withBackend(ptrguard.BackendQueue, func() {
+		buffer := make([]byte, 4)
+		iovec := make([]C.Iovec, 1)
+		var pinner ptrguard.Pinner
+		defer pinner.Unpin()
+		pinner.PinBytes(buffer).Store(&iovec[0].Base)
+		iovec[0].Len = C.Int(len(buffer))
+		// NoCheck() can't disable cgocheck, so the cgocheck call must be
+		// shadowed.
+		assert.Panics(t, func() {
+			ptrguard.NoCheck(func() { C.FillBuffersWithX(&iovec[0], len(iovec)) })
+		})
+		C.FillBuffersWithXUnchecked(&iovec[0], len(iovec))
+		assert.Equal(t, "XXXX", string(buffer))
+		assert.Equal(t, unsafe.Pointer(&buffer[0]), iovec[0].Base)
+	})
+}
@@ -0,0 +1,51 @@
+//go:build cgo
+// +build cgo
+
+// Package cutils provides helpers for passing Go memory to C with ptrguard, that
+// allocate the C data structures referring to it.
+package cutils
+
+/*
+#include <stdlib.h>
+#include <sys/uio.h>
+*/
+import "C"
+
+import (
+	"math"
+	"unsafe"
+
+	"github.com/ansiwen/ptrguard"
+)
+
+// BuildIovec allocates a C array of struct iovec with an entry for each of the
+// buffers, pins all buffers with the Pinner p and stores their pointers in the
+// entries, and returns the base of the array and its number of entries, e.g.
+// for readv() or writev(). The caller owns the array and must release it with
+// Free(), but only after `Unpin()` of p has been called, which zeroes the
+// stored pointers. Empty buffers result in an entry with a nil base and a zero
+// length. For no buffers at all nothing is allocated and nil is returned.
+func BuildIovec(p *ptrguard.Pinner, buffers [][]byte) (base unsafe.Pointer, n int) {
+	n = len(buffers)
+	if n == 0 {
+		return nil, 0
+	}
+	base = C.calloc(C.size_t(n), C.sizeof_struct_iovec)
+	if base == nil {
+		panic("cutils: out of memory")
+	}
+	iovec := (*[math.MaxInt32 / C.sizeof_struct_iovec]C.struct_iovec)(base)[:n:n]
+	for i := range buffers {
+		if len(buffers[i]) == 0 {
+			continue
+		}
+		p.PinBytes(buffers[i]).StorePointer(&iovec[i].iov_base)
+		iovec[i].iov_len = C.size_t(len(buffers[i]))
+	}
+	return base, n
+}
+
+// Free frees C memory allocated by this package.
+func Free(ptr unsafe.Pointer) {
+	C.free(ptr)
+}
@@ -0,0 +1,51 @@
+//go:build cgo && linux
+// +build cgo,linux
+
+package cutils_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ansiwen/ptrguard"
+	"github.com/ansiwen/ptrguard/cutils"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestBuildIovec(t *testing.T) {
+	var buffers [][]byte
+	for i := 2; i < 12; i += 3 {
+		buffers = append(buffers, make([]byte, i))
+	}
+	buffers = append(buffers, nil)
+	var fds [2]int
+	assert.NoError(t, unix.Pipe(fds[:]))
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+	total := 0
+	for i := range buffers {
+		total += len(buffers[i])
+	}
+	_, err := unix.Write(fds[1], []byte(strings.Repeat("X", total)))
+	assert.NoError(t, err)
+
+	var pg ptrguard.Pinner
+	base, n := cutils.BuildIovec(&pg, buffers)
+	defer cutils.Free(base)
+	assert.Equal(t, len(buffers), n)
+	assert.Equal(t, len(buffers)-1, pg.Len())
+	// readv() fills the buffers in C code of the kernel.
+	read, _, errno := unix.Syscall(unix.SYS_READV, uintptr(fds[0]),
+		uintptr(base), uintptr(n))
+	assert.Zero(t, errno)
+	assert.EqualValues(t, total, read)
+	pg.Unpin()
+	for i := range buffers {
+		assert.Equal(t, strings.Repeat("X", len(buffers[i])), string(buffers[i]))
+	}
+
+	base, n = cutils.BuildIovec(&pg, nil)
+	assert.Zero(t, base)
+	assert.Zero(t, n)
+}
@@ -0,0 +1,120 @@
+package ptrguard
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// ErrNotAPointer matches the errors of `TryPin()` with errors.Is(), if the
+// argument is not a pointer.
+var ErrNotAPointer = errors.New("ptrguard: not a pointer")
+
+// ErrNotAPointerToPointer matches the errors of `TryStore()` with errors.Is(),
+// if the target is not a pointer to a pointer.
+var ErrNotAPointerToPointer = errors.New("ptrguard: not a pointer to a pointer")
+
+// ErrStoreAfterUnpin is the panic value of `Store()`, if the pinned pointer has
+// already been unpinned.
+var ErrStoreAfterUnpin = errors.New("ptrguard: Store after Unpin(). The " +
+	"pointer is not pinned anymore.")
+
+// ErrStalePointer matches the panic value of `Store()` in debug mode with
+// errors.Is(), if the object of the pinned pointer is not pinned anymore.
+var ErrStalePointer = errors.New("ptrguard: stale pointer")
+
+// ErrForeignCheckUnavailable is returned by `SetForeignPointerMode()` and
+// `SetStrictStore()`, if the package has been built without cgo or without the
+// build tag ptrguard_foreigncheck, so that pointers can't be checked.
+var ErrForeignCheckUnavailable = errors.New("ptrguard: the foreign pointer " +
+	"check needs cgo and the build tag ptrguard_foreigncheck")
+
+// NotPointerError is returned by `TryPin()` and is the panic value of `Pin()`,
+// if the argument is not a pointer. Type is the type of the argument, which is
+// nil for a nil interface.
+type NotPointerError struct {
+	Type reflect.Type
+}
+
+func (e *NotPointerError) Error() string {
+	return fmt.Sprintf("%s is not a pointer", typeString(e.Type))
+}
+
+// Is reports whether target is ErrNotAPointer.
+func (e *NotPointerError) Is(target error) bool {
+	return target == ErrNotAPointer
+}
+
+// NotPointerToPointerError is returned by `TryStore()` and is the panic value of
+// `Store()`, if the target is not a pointer to a pointer. Type is the type of
+// the target, which is nil for a nil interface.
+type NotPointerToPointerError struct {
+	Type reflect.Type
+}
+
+func (e *NotPointerToPointerError) Error() string {
+	return fmt.Sprintf("%s is not a pointer to a pointer", typeString(e.Type))
+}
+
+// Is reports whether target is ErrNotAPointerToPointer.
+func (e *NotPointerToPointerError) Is(target error) bool {
+	return target == ErrNotAPointerToPointer
+}
+
+// LeakError is the panic value, when the garbage collector finds a Pinner with
+// pinned objects, that has not been unpinned. Pins is the number of objects,
+// that were still pinned by the Pinner. In debug mode Stacks contains the
+// formatted call stacks of all pins of the Pinner, see SetDebug().
+type LeakError struct {
+	Pins   int
+	Stacks []string
+}
+
+func (e *LeakError) Error() string {
+	msg := "ptrguard: Found leaking pinned pointer. Forgot to call Unpin()?"
+	if e.Pins > 0 {
+		msg = fmt.Sprintf("ptrguard: Found %d leaking pinned pointer(s). "+
+			"Forgot to call Unpin()?", e.Pins)
+	}
+	for _, stack := range e.Stacks {
+		msg += "\n\nPinned at:\n" + stack
+	}
+	return msg
+}
+
+// StalePointerError is the panic value of `Store()` in debug mode, if the
+// object of the pinned pointer Ptr is not kept alive by its Pinner anymore,
+// although the Pinned value has not been unpinned, see SetDebug().
+type StalePointerError struct {
+	Ptr unsafe.Pointer
+}
+
+func (e *StalePointerError) Error() string {
+	return fmt.Sprintf("ptrguard: Storing stale pointer %p, that is not "+
+		"pinned anymore. Stored a copy of an unpinned Pinned value?", e.Ptr)
+}
+
+// Is reports whether target is ErrStalePointer.
+func (e *StalePointerError) Is(target error) bool {
+	return target == ErrStalePointer
+}
+
+// RefsLimitError is passed to the handler set by SetRefsLimitHandler(), when a
+// pinned pointer is stored more often than the limit of SetMaxStoredRefs()
+// allows. Limit is the limit of the Pinner.
+type RefsLimitError struct {
+	Limit int
+}
+
+func (e *RefsLimitError) Error() string {
+	return fmt.Sprintf("ptrguard: Exceeded the limit of %d stored pointers. "+
+		"Storing in an unbounded loop?", e.Limit)
+}
+
+func typeString(t reflect.Type) string {
+	if t == nil {
+		return "<nil>"
+	}
+	return t.String()
+}
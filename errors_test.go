@@ -0,0 +1,95 @@
+package ptrguard_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/ansiwen/ptrguard"
+	"github.com/stretchr/testify/assert"
+)
+
+func recoverValue(f func()) (r interface{}) {
+	defer func() { r = recover() }()
+	f()
+	return nil
+}
+
+func TestNotPointerError(t *testing.T) {
+	var pinner ptrguard.Pinner
+	defer pinner.Unpin()
+	r := recoverValue(func() { pinner.Pin(42) })
+	if assert.IsType(t, &ptrguard.NotPointerError{}, r) {
+		err := r.(*ptrguard.NotPointerError)
+		assert.Equal(t, reflect.TypeOf(42), err.Type)
+		assert.EqualError(t, err, "int is not a pointer")
+	}
+	r = recoverValue(func() { pinner.Pin(nil) })
+	if assert.IsType(t, &ptrguard.NotPointerError{}, r) {
+		err := r.(*ptrguard.NotPointerError)
+		assert.Nil(t, err.Type)
+		assert.EqualError(t, err, "<nil> is not a pointer")
+	}
+	pinned, err := pinner.TryPin("foo")
+	assert.Nil(t, pinned)
+	if assert.IsType(t, &ptrguard.NotPointerError{}, err) {
+		assert.Equal(t, reflect.TypeOf(""), err.(*ptrguard.NotPointerError).Type)
+	}
+	pinned, err = pinner.TryPin(new(int))
+	assert.NoError(t, err)
+	assert.NotNil(t, pinned)
+	assert.Equal(t, "Pinner{pinned:1, stored:0}", pinner.String())
+}
+
+func TestNotPointerToPointerError(t *testing.T) {
+	var pinner ptrguard.Pinner
+	defer pinner.Unpin()
+	pinned := pinner.Pin(new(int))
+	var target unsafe.Pointer
+	r := recoverValue(func() { pinned.Store(target) })
+	if assert.IsType(t, &ptrguard.NotPointerToPointerError{}, r) {
+		err := r.(*ptrguard.NotPointerToPointerError)
+		assert.Equal(t, reflect.TypeOf(target), err.Type)
+		assert.EqualError(t, err, "unsafe.Pointer is not a pointer to a pointer")
+	}
+}
+
+func TestErrNotAPointer(t *testing.T) {
+	var pinner ptrguard.Pinner
+	defer pinner.Unpin()
+	_, err := pinner.TryPin(struct{}{})
+	assert.True(t, errors.Is(err, ptrguard.ErrNotAPointer))
+	var notPointer *ptrguard.NotPointerError
+	if assert.True(t, errors.As(err, &notPointer)) {
+		assert.Equal(t, reflect.TypeOf(struct{}{}), notPointer.Type)
+	}
+	_, err = pinner.TryPin(unsafe.Pointer(nil))
+	assert.False(t, errors.Is(err, ptrguard.ErrNotAPointer))
+	assert.False(t, errors.Is(&ptrguard.NotPointerToPointerError{},
+		ptrguard.ErrNotAPointer))
+}
+
+func TestTryStore(t *testing.T) {
+	var pinner ptrguard.Pinner
+	defer pinner.Unpin()
+	x := 42
+	pinned := pinner.Pin(&x)
+	var intPtr *int
+	assert.NoError(t, pinned.TryStore(&intPtr))
+	assert.Equal(t, &x, intPtr)
+	var ptr unsafe.Pointer
+	assert.NoError(t, pinned.TryStore(&ptr))
+	assert.Equal(t, unsafe.Pointer(&x), ptr)
+	for _, target := range []interface{}{&x, x, nil} {
+		err := pinned.TryStore(target)
+		assert.True(t, errors.Is(err, ptrguard.ErrNotAPointerToPointer), target)
+		var notPointer *ptrguard.NotPointerToPointerError
+		if assert.True(t, errors.As(err, &notPointer)) {
+			assert.Equal(t, reflect.TypeOf(target), notPointer.Type)
+		}
+	}
+	assert.Equal(t, 2, pinner.StoredCount())
+	assert.False(t, errors.Is(&ptrguard.NotPointerError{},
+		ptrguard.ErrNotAPointerToPointer))
+}
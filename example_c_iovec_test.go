@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 package ptrguard_test
 
 import (
@@ -20,7 +23,8 @@ func Example_cAllocatedIovec() {
 	defer C.Free(cPtr)
 	// This is a trick to create a slice on top of the C allocated array, for
 	// easier and safer access.
-	iovec := (*[math.MaxInt32]C.Iovec)(cPtr)[:numberOfBuffers:numberOfBuffers]
+	// The array type must fit into the address space of 32-bit platforms.
+	iovec := (*[math.MaxInt32 / C.SizeOfIovec]C.Iovec)(cPtr)[:numberOfBuffers:numberOfBuffers]
 
 	var pinner ptrguard.Pinner
 	defer pinner.Unpin()
@@ -0,0 +1,47 @@
+package ptrguard
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	expvarOnce sync.Once
+	countPins  int32 // 1 if the active pins are counted
+	activePins int64
+)
+
+// EnableExpvar publishes the number of objects, that are currently pinned by all
+// Pinners of the process, as the expvar "ptrguard.active_pins", e.g. to monitor
+// a long-running server. Only pins made after EnableExpvar() are counted, so it
+// should be called before any Pinner is used. Since counting has a small
+// overhead for each pin, it is disabled by default. Calling it more than once
+// has no effect.
+func EnableExpvar() {
+	expvarOnce.Do(func() {
+		atomic.StoreInt32(&countPins, 1)
+		expvar.Publish("ptrguard.active_pins", expvar.Func(func() interface{} {
+			return atomic.LoadInt64(&activePins)
+		}))
+	})
+}
+
+// countPin counts a new pin of d, if counting is enabled.
+func (d *data) countPin() {
+	if atomic.LoadInt32(&countPins) != 0 {
+		d.counted++
+		atomic.AddInt64(&activePins, 1)
+	}
+}
+
+// uncountPins uncounts n released pins of d, as far as they have been counted.
+func (d *data) uncountPins(n int) {
+	if n > d.counted {
+		n = d.counted
+	}
+	if n > 0 {
+		d.counted -= n
+		atomic.AddInt64(&activePins, -int64(n))
+	}
+}
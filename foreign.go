@@ -0,0 +1,95 @@
+package ptrguard
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// ForeignPointerMode configures how Pin() handles pointers, that don't point
+// into the Go heap, like pointers to C memory allocated by malloc. Such memory
+// is never moved or freed by the garbage collector, so pinning it is
+// unnecessary and usually a sign of a conceptual mistake.
+type ForeignPointerMode int
+
+const (
+	// ForeignPointerIgnore pins all pointers without checking. This is the
+	// default.
+	ForeignPointerIgnore ForeignPointerMode = iota
+	// ForeignPointerWarn prints a warning for pointers outside of the Go
+	// heap, and pins them anyway.
+	ForeignPointerWarn
+	// ForeignPointerSkip silently skips pinning pointers outside of the Go
+	// heap. Their Pinned values can still be stored as usual.
+	ForeignPointerSkip
+)
+
+var foreignPointerMode ForeignPointerMode
+
+// SetForeignPointerMode sets how Pin() handles pointers outside of the Go heap.
+// The check is only a best effort: it relies on cgocheck, so it isn't
+// performed when cgocheck is disabled, e.g. inside of NoCheck(). Since it needs
+// a C call, it is only available, if the package is built with cgo and the
+// build tag ptrguard_foreigncheck, otherwise any mode other than
+// ForeignPointerIgnore is rejected with ErrForeignCheckUnavailable, and the
+// mode is not changed. Since Go 1.21 cgocheck accepts objects pinned by a
+// runtime.Pinner, so objects pinned with BackendRuntime are only recognized by
+// the pointers they have been pinned with, while pointers into them, or
+// objects pinned by a runtime.Pinner outside of this package, are considered
+// foreign. It should be set before any Pinner is used.
+func SetForeignPointerMode(mode ForeignPointerMode) error {
+	if mode != ForeignPointerIgnore && !foreignCheckAvailable {
+		return ErrForeignCheckUnavailable
+	}
+	foreignPointerMode = mode
+	return nil
+}
+
+var strictStore bool
+
+// SetStrictStore enables or disables the strict store mode. In this mode the
+// `Store()` methods panic, if the target is in Go memory instead of C memory.
+// Storing a pinned pointer in Go memory defeats its purpose and may violate
+// the pointer passing rules, if that memory is passed to C. Like the foreign
+// pointer check, this check is only a best effort: it relies on cgocheck, so it
+// isn't performed when cgocheck is disabled, e.g. inside of NoCheck(). Without
+// cgo or the build tag ptrguard_foreigncheck it can't be enabled and
+// ErrForeignCheckUnavailable is returned. Also Go memory, that is pinned
+// itself, is not recognized with all backends. It has some overhead for each
+// store, so it is disabled by default.
+func SetStrictStore(enabled bool) error {
+	if enabled && !foreignCheckAvailable {
+		return ErrForeignCheckUnavailable
+	}
+	strictStore = enabled
+	return nil
+}
+
+// checkStoreTarget panics in strict store mode, if target is in Go memory.
+func checkStoreTarget(target *unsafe.Pointer) {
+	if strictStore && CgoCheckLevel() != 0 && isGoPointer(unsafe.Pointer(target)) {
+		panic(fmt.Sprintf("ptrguard: Storing pinned pointer in Go memory at %p. "+
+			"Stores are only allowed in C memory in strict store mode.", target))
+	}
+}
+
+// skipPin reports whether ptr should not be pinned according to the foreign
+// pointer mode.
+func skipPin(ptr unsafe.Pointer) bool {
+	if foreignPointerMode == ForeignPointerIgnore || isGoPointer(ptr) ||
+		isRuntimePinned(ptr) {
+		return false
+	}
+	if foreignPointerMode == ForeignPointerWarn {
+		foreignPointerWarning(ptr)
+		return false
+	}
+	return true
+}
+
+// To be able to test the check, this warning function is a variable, that can
+// be overwritten by a test.
+var foreignPointerWarning = func(ptr unsafe.Pointer) {
+	fmt.Fprintf(os.Stderr, "ptrguard: Pinning pointer %p, that is not "+
+		"pointing into the Go heap. Is it pointing to C memory?\n", ptr)
+}
@@ -0,0 +1,40 @@
+//go:build cgo && ptrguard_foreigncheck
+// +build cgo,ptrguard_foreigncheck
+
+package ptrguard
+
+/*
+static inline void ptrguard_probe(void* p) {}
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+// foreignCheckAvailable reports whether isGoPointer() can check pointers.
+const foreignCheckAvailable = true
+
+// probeCell is a heap allocated cell of a pointer type, so that cgocheck
+// inspects its content when a pointer to it is passed to C. It is guarded by
+// the cgocheck lock.
+var probeCell = new(unsafe.Pointer)
+
+// isGoPointer uses cgocheck to find out whether ptr points into the Go heap: it
+// panics when a C function is called with a pointer to Go memory containing a
+// Go pointer. The cgocheck setting is locked during the probe, so that it can't
+// be disabled by NoCheck() meanwhile. If cgocheck is disabled, it reports true.
+func isGoPointer(ptr unsafe.Pointer) (goPtr bool) {
+	enabled := lockCgoCheck()
+	defer unlockCgoCheck()
+	if !enabled {
+		return true
+	}
+	defer func() {
+		goPtr = recover() != nil
+		*probeCell = nil
+	}()
+	*probeCell = ptr
+	C.ptrguard_probe(unsafe.Pointer(probeCell))
+	return false
+}
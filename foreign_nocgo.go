@@ -0,0 +1,17 @@
+//go:build !cgo || !ptrguard_foreigncheck
+// +build !cgo !ptrguard_foreigncheck
+
+package ptrguard
+
+import (
+	"unsafe"
+)
+
+// Without cgo, or without the build tag ptrguard_foreigncheck, that enables the
+// probe with a C call, there is no way to check, so the foreign pointer check
+// can't be enabled, and every pointer is assumed to be a Go pointer.
+const foreignCheckAvailable = false
+
+func isGoPointer(unsafe.Pointer) bool {
+	return true
+}
@@ -0,0 +1,20 @@
+//go:build !go1.21 || !cgo || !ptrguard_foreigncheck
+// +build !go1.21 !cgo !ptrguard_foreigncheck
+
+package ptrguard
+
+import (
+	"unsafe"
+)
+
+// Without the foreign pointer probe, or before Go 1.21, where cgocheck doesn't
+// accept pinned objects, the pins of the runtime backend don't need to be
+// tracked.
+
+func trackRuntimePin(unsafe.Pointer) {}
+
+func untrackRuntimePins(...unsafe.Pointer) {}
+
+func isRuntimePinned(unsafe.Pointer) bool {
+	return false
+}
@@ -0,0 +1,53 @@
+//go:build go1.21 && cgo && ptrguard_foreigncheck
+// +build go1.21,cgo,ptrguard_foreigncheck
+
+package ptrguard
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// Since Go 1.21 cgocheck accepts Go pointers to objects, that are pinned by a
+// runtime.Pinner, so the probe of isGoPointer() considers them foreign.
+// Therefore the objects pinned by the runtime backend are registered, so that
+// they can be recognized as Go pointers by their pinned pointers.
+var (
+	runtimePinnedMtx sync.Mutex
+	// number of pins of each object pinned by the runtime backend
+	runtimePinned = make(map[unsafe.Pointer]int)
+)
+
+// trackRuntimePin registers ptr, before it is pinned by the runtime backend,
+// if it is a Go pointer. Pointers to C memory are ignored by runtime.Pinner, so
+// they are not registered either.
+func trackRuntimePin(ptr unsafe.Pointer) {
+	runtimePinnedMtx.Lock()
+	defer runtimePinnedMtx.Unlock()
+	if n := runtimePinned[ptr]; n > 0 || isGoPointer(ptr) {
+		runtimePinned[ptr] = n + 1
+	}
+}
+
+// untrackRuntimePins unregisters one pin of each of ptrs, that are released by
+// the runtime backend.
+func untrackRuntimePins(ptrs ...unsafe.Pointer) {
+	runtimePinnedMtx.Lock()
+	defer runtimePinnedMtx.Unlock()
+	for _, ptr := range ptrs {
+		switch n := runtimePinned[ptr]; n {
+		case 0:
+		case 1:
+			delete(runtimePinned, ptr)
+		default:
+			runtimePinned[ptr] = n - 1
+		}
+	}
+}
+
+// isRuntimePinned reports whether ptr is pinned by the runtime backend.
+func isRuntimePinned(ptr unsafe.Pointer) bool {
+	runtimePinnedMtx.Lock()
+	defer runtimePinnedMtx.Unlock()
+	return runtimePinned[ptr] > 0
+}
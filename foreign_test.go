@@ -0,0 +1,106 @@
+//go:build cgo && ptrguard_foreigncheck
+// +build cgo,ptrguard_foreigncheck
+
+package ptrguard // nolint:testpackage
+
+import (
+	"testing"
+	"unsafe"
+
+	. "github.com/ansiwen/ptrguard/internal/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForeignPointerMode(t *testing.T) {
+	if CgoCheckLevel() < 0 {
+		t.Skip("the check depends on cgocheck")
+	}
+	var warned []unsafe.Pointer
+	defer func(f func(unsafe.Pointer)) { foreignPointerWarning = f }(foreignPointerWarning)
+	foreignPointerWarning = func(ptr unsafe.Pointer) {
+		warned = append(warned, ptr)
+	}
+	defer SetForeignPointerMode(ForeignPointerIgnore)
+	cMem := Malloc(8)
+	defer Free(cMem)
+	goMem := make([]byte, 8)
+	var pg Pinner
+	defer pg.Unpin()
+
+	pg.Pin(cMem)
+	assert.Empty(t, warned)
+	assert.Equal(t, 1, pg.pinned)
+
+	assert.NoError(t, SetForeignPointerMode(ForeignPointerWarn))
+	pg.Pin(&goMem[0])
+	assert.Empty(t, warned)
+	pg.Pin(cMem)
+	assert.Equal(t, []unsafe.Pointer{cMem}, warned)
+	assert.Equal(t, 3, pg.pinned)
+
+	assert.NoError(t, SetForeignPointerMode(ForeignPointerSkip))
+	cPtr := (*unsafe.Pointer)(Malloc(unsafe.Sizeof(uintptr(0))))
+	defer Free(unsafe.Pointer(cPtr))
+	pg.Pin(cMem).Store(cPtr)
+	assert.Equal(t, cMem, *cPtr)
+	assert.Equal(t, 3, pg.pinned)
+	assert.Len(t, warned, 1)
+	pg.Unpin()
+	assert.Zero(t, *cPtr)
+}
+
+func TestStrictStore(t *testing.T) {
+	if CgoCheckLevel() < 0 {
+		t.Skip("the check depends on cgocheck")
+	}
+	defer SetStrictStore(false)
+	assert.NoError(t, SetStrictStore(true))
+	s := "fooBar"
+	cPtr := (*unsafe.Pointer)(Malloc(unsafe.Sizeof(uintptr(0))))
+	defer Free(unsafe.Pointer(cPtr))
+	goPtr := new(unsafe.Pointer)
+	var pg Pinner
+	pp := pg.Pin(&s)
+	pp.Store(cPtr)
+	assert.Equal(t, unsafe.Pointer(&s), *cPtr)
+	assert.Panics(t, func() { pp.Store(goPtr) })
+	assert.Panics(t, func() { pp.StoreCAS(goPtr, nil) })
+	assert.Zero(t, *goPtr)
+	assert.Equal(t, 1, pg.StoredCount())
+	NoCheck(func() { pp.Store(goPtr) })
+	assert.NoError(t, SetStrictStore(false))
+	pp.Store(goPtr)
+	pg.Unpin()
+	assert.Zero(t, *cPtr)
+	assert.Zero(t, *goPtr)
+}
+
+func TestForeignPointerRuntimePinned(t *testing.T) {
+	if CgoCheckLevel() < 0 {
+		t.Skip("the check depends on cgocheck")
+	}
+	if _, ok := newKeeper[BackendRuntime]; !ok {
+		t.Skip("runtime backend not available")
+	}
+	defer SetBackend(CurrentBackend())
+	SetBackend(BackendRuntime)
+	defer SetForeignPointerMode(ForeignPointerIgnore)
+	assert.NoError(t, SetForeignPointerMode(ForeignPointerSkip))
+	goMem := make([]byte, 8)
+	var pg1, pg2 Pinner
+	defer pg1.Unpin()
+	defer pg2.Unpin()
+	pg1.Pin(&goMem[0])
+	// cgocheck accepts the pinned object, but it is still recognized as a Go
+	// pointer.
+	assert.False(t, isGoPointer(unsafe.Pointer(&goMem[0])))
+	pg1.Pin(&goMem[0])
+	pg2.Pin(&goMem[0])
+	assert.Equal(t, 2, pg1.Len())
+	assert.Equal(t, 1, pg2.Len())
+	pg1.Unpin()
+	assert.True(t, isRuntimePinned(unsafe.Pointer(&goMem[0])))
+	pg2.Unpin()
+	assert.False(t, isRuntimePinned(unsafe.Pointer(&goMem[0])))
+	assert.True(t, isGoPointer(unsafe.Pointer(&goMem[0])))
+}
@@ -0,0 +1,24 @@
+//go:build !cgo || !ptrguard_foreigncheck
+// +build !cgo !ptrguard_foreigncheck
+
+package ptrguard_test
+
+import (
+	"testing"
+
+	"github.com/ansiwen/ptrguard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForeignPointerModeUnavailable(t *testing.T) {
+	assert.Equal(t, ptrguard.ErrForeignCheckUnavailable,
+		ptrguard.SetForeignPointerMode(ptrguard.ForeignPointerWarn))
+	assert.Equal(t, ptrguard.ErrForeignCheckUnavailable,
+		ptrguard.SetForeignPointerMode(ptrguard.ForeignPointerSkip))
+	assert.NoError(t, ptrguard.SetForeignPointerMode(ptrguard.ForeignPointerIgnore))
+}
+
+func TestStrictStoreUnavailable(t *testing.T) {
+	assert.Equal(t, ptrguard.ErrForeignCheckUnavailable, ptrguard.SetStrictStore(true))
+	assert.NoError(t, ptrguard.SetStrictStore(false))
+}
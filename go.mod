@@ -2,4 +2,7 @@ module github.com/ansiwen/ptrguard
 
 go 1.13
 
-require github.com/stretchr/testify v1.7.0
+require (
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/sys v0.0.0-20210510120138-977fb7262007
+)
@@ -0,0 +1,28 @@
+//go:build go1.17 && cgo
+// +build go1.17,cgo
+
+package ptrguard
+
+import "runtime/cgo"
+
+// AsHandle returns a new cgo.Handle of the pinned pointer, whose Value() is the
+// pointer as unsafe.Pointer. The handle is deleted by `Unpin()` of the Pinner,
+// so it has the same lifetime as the pin. This can be used with C APIs, that
+// take an opaque integer context, which is passed back to Go callbacks, when
+// the callbacks need the actual pointer, e.g. to hand it to other C functions.
+// If the pointer is only used by C, prefer Store(), which doesn't need the
+// handle map. AsHandle() panics for the no-op Pinned values of empty inputs and
+// with ErrStoreAfterUnpin, if the pointer has already been unpinned.
+func (p *Pinned) AsHandle() cgo.Handle {
+	data := p.lock()
+	if data == nil {
+		panic("ptrguard: AsHandle() of an empty pin")
+	}
+	defer data.mtx.Unlock()
+	if data.released || p.released {
+		panic(ErrStoreAfterUnpin)
+	}
+	h := cgo.NewHandle(p.ptr)
+	data.frees = append(data.frees, h.Delete)
+	return h
+}
@@ -0,0 +1,31 @@
+//go:build go1.17 && cgo
+// +build go1.17,cgo
+
+package ptrguard_test
+
+import (
+	"runtime/cgo"
+	"testing"
+	"unsafe"
+
+	"github.com/ansiwen/ptrguard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsHandle(t *testing.T) {
+	s := fooBar
+	var pg ptrguard.Pinner
+	pinned := pg.Pin(&s)
+	h := pinned.AsHandle()
+	// C passes the handle back as integer.
+	ctx := uintptr(h)
+	ptr := cgo.Handle(ctx).Value().(unsafe.Pointer)
+	assert.Equal(t, unsafe.Pointer(&s), ptr)
+	assert.Equal(t, fooBar, *(*string)(ptr))
+	assert.NotEqual(t, h, pinned.AsHandle())
+	pg.Unpin()
+	assert.Panics(t, func() { h.Value() })
+	assert.PanicsWithValue(t, ptrguard.ErrStoreAfterUnpin,
+		func() { pinned.AsHandle() })
+	assert.Panics(t, func() { pg.PinBytes(nil).AsHandle() })
+}
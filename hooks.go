@@ -0,0 +1,25 @@
+package ptrguard
+
+import "unsafe"
+
+var (
+	onPin   func(ptr unsafe.Pointer)
+	onUnpin func(count int)
+)
+
+// SetOnPin sets a function, that is called with the pinned pointer after each
+// pin of an object by any Pinner, e.g. for collecting metrics or tracing. It is
+// called without holding any internal locks, so it may use the Pinner. Passing
+// nil removes the hook, which is the default. When no hook is set, there is no
+// overhead. It should be set before any Pinner is used.
+func SetOnPin(fn func(ptr unsafe.Pointer)) {
+	onPin = fn
+}
+
+// SetOnUnpin sets a function, that is called after each `Unpin()` of any
+// Pinner with the number of released pins, which is 1 for `Unpin()` of a Pinned
+// value. Like the hook of SetOnPin(), it is called without holding any internal
+// locks, and it should be set before any Pinner is used.
+func SetOnUnpin(fn func(count int)) {
+	onUnpin = fn
+}
@@ -2,6 +2,7 @@
 package testhelper
 
 /*
+#include <stdint.h>
 #include <stdlib.h>
 
 void dummyCall(void* p) {}
@@ -18,6 +19,21 @@ inline void fillBufsWithX(iovec* bufs, int n) {
 		}
 	}
 }
+
+// args is a list of (buffer, length) pairs.
+inline int sumBytesArgs(uintptr_t* args, int n) {
+	int sum = 0;
+	for (int i = 0; i+1<n; i+=2) {
+		for (int j = 0; j<args[i+1]; ++j) {
+			sum += ((char*)(args[i]))[j];
+		}
+	}
+	return sum;
+}
+
+inline char* derefCharPtr(char** p) {
+	return *p;
+}
 */
 import "C"
 
@@ -55,3 +71,19 @@ func DummyCCall(p unsafe.Pointer) {
 func FillBuffersWithX(iovec *Iovec, n int) {
 	C.fillBufsWithX((*C.iovec)(iovec), C.int(n))
 }
+
+// FillBuffersWithXUnchecked ...
+func FillBuffersWithXUnchecked(iovec *Iovec, n int) {
+	_cgoCheckPointer := func(interface{}, interface{}) {}
+	C.fillBufsWithX((*C.iovec)(iovec), C.int(n))
+}
+
+// SumBytesArgs ...
+func SumBytesArgs(args []uintptr) int {
+	return int(C.sumBytesArgs((*C.uintptr_t)(unsafe.Pointer(&args[0])), C.int(len(args))))
+}
+
+// GoStringNAt ...
+func GoStringNAt(charPtrPtr unsafe.Pointer, n int) string {
+	return C.GoStringN(C.derefCharPtr((**C.char)(charPtrPtr)), C.int(n))
+}
@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+// Package iouring provides helpers for using ptrguard with io_uring.
+package iouring
+
+import (
+	"github.com/ansiwen/ptrguard"
+	"golang.org/x/sys/unix"
+)
+
+// RegisterBuffers pins all buffers with the Pinner p and returns an iovec slice
+// describing them, that can be passed to the io_uring_register() system call
+// with IORING_REGISTER_BUFFERS. The buffers stay pinned until `Unpin()` of p is
+// called, which must happen only after the buffers have been unregistered again
+// with IORING_UNREGISTER_BUFFERS, because the kernel accesses them directly as
+// long as they are registered. Empty buffers result in an iovec entry with a
+// nil base and a zero length.
+func RegisterBuffers(p *ptrguard.Pinner, buffers [][]byte) []unix.Iovec {
+	iovec := make([]unix.Iovec, len(buffers))
+	for i := range buffers {
+		if len(buffers[i]) == 0 {
+			continue
+		}
+		p.PinBytes(buffers[i])
+		iovec[i].Base = &buffers[i][0]
+		iovec[i].SetLen(len(buffers[i]))
+	}
+	return iovec
+}
@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package iouring_test
+
+import (
+	"testing"
+
+	"github.com/ansiwen/ptrguard"
+	"github.com/ansiwen/ptrguard/iouring"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterBuffers(t *testing.T) {
+	var buffers [][]byte
+	for i := 2; i < 12; i += 3 {
+		buffers = append(buffers, make([]byte, i))
+	}
+	buffers = append(buffers, nil)
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	iovec := iouring.RegisterBuffers(&pg, buffers)
+	assert.Len(t, iovec, len(buffers))
+	for i := range buffers {
+		if len(buffers[i]) > 0 {
+			assert.Equal(t, &buffers[i][0], iovec[i].Base)
+		} else {
+			assert.Nil(t, iovec[i].Base)
+		}
+		assert.EqualValues(t, len(buffers[i]), iovec[i].Len)
+	}
+}
@@ -0,0 +1,61 @@
+package ptrguard
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	leakCheckAtExit int32 // 1 if the active Pinners are registered
+	activeMtx       sync.Mutex
+	active          = make(map[*data]struct{})
+)
+
+// CheckLeaksAtExit enables a registry of all Pinners, that have been used and
+// not unpinned yet, which can be queried with Leaks(). Since the leak detection
+// relies on finalizers, which are not guaranteed to run before the process
+// exits, it can miss leaks, e.g. in short test binaries. Go has no atexit
+// mechanism, so Leaks() must be called explicitly at the end, e.g. in TestMain()
+// after m.Run(), see ptrguardtest.Main(). Only Pinners used after
+// CheckLeaksAtExit() are registered, so it should be called before any Pinner
+// is used. Registering has a small overhead for each use of a Pinner, so it is
+// disabled by default.
+func CheckLeaksAtExit() {
+	atomic.StoreInt32(&leakCheckAtExit, 1)
+}
+
+// Leaks returns a *LeakError for each registered Pinner, that has been used,
+// but not unpinned yet, see CheckLeaksAtExit(). In debug mode they contain the
+// call stacks of the pins, see SetDebug().
+func Leaks() []*LeakError {
+	activeMtx.Lock()
+	defer activeMtx.Unlock()
+	var leaks []*LeakError
+	for d := range active {
+		d.mtx.Lock()
+		leaks = append(leaks, &LeakError{
+			Pins:   d.pinned,
+			Stacks: formatStacks(d.stacks()),
+		})
+		d.mtx.Unlock()
+	}
+	return leaks
+}
+
+// registerActive registers the new data d, if the registry is enabled.
+func registerActive(d *data) {
+	if atomic.LoadInt32(&leakCheckAtExit) != 0 {
+		activeMtx.Lock()
+		active[d] = struct{}{}
+		activeMtx.Unlock()
+	}
+}
+
+// unregisterActive removes the unpinned data d from the registry.
+func unregisterActive(d *data) {
+	if atomic.LoadInt32(&leakCheckAtExit) != 0 {
+		activeMtx.Lock()
+		delete(active, d)
+		activeMtx.Unlock()
+	}
+}
@@ -0,0 +1,12 @@
+//go:build go1.18
+// +build go1.18
+
+package ptrguard
+
+// NoCheckReturn is like NoCheck(), but it returns the value returned by f, e.g.
+// the result of the C call made by f. cgocheck is restored, even if f panics.
+func NoCheckReturn[T any](f func() T) T {
+	cgocheckOff()
+	defer cgocheckOn()
+	return f()
+}
@@ -0,0 +1,29 @@
+//go:build go1.18 && cgo
+// +build go1.18,cgo
+
+package ptrguard_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/ansiwen/ptrguard"
+	C "github.com/ansiwen/ptrguard/internal/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoCheckReturn(t *testing.T) {
+	requireCgoCheck(t)
+	s := fooBar
+	goPtr := (unsafe.Pointer)(&s)
+	goPtrPtr := (unsafe.Pointer)(&goPtr)
+	n := ptrguard.NoCheckReturn(func() int {
+		C.DummyCCall(goPtrPtr)
+		return 42
+	})
+	assert.Equal(t, 42, n)
+	assert.Panics(t, func() {
+		ptrguard.NoCheckReturn(func() int { panic("foo") })
+	})
+	assert.Panics(t, func() { C.DummyCCall(goPtrPtr) })
+}
@@ -0,0 +1,29 @@
+//go:build !race
+// +build !race
+
+package ptrguard
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// Without the race detector the consistency checks of the stores are no-ops,
+// see race.go.
+
+func (d *data) raceAddTarget(target *unsafe.Pointer) {}
+
+func (d *data) raceRemoveTarget(target *unsafe.Pointer) {}
+
+func (d *data) raceReleaseTargets() {}
+
+func (d *data) raceMoveTargets(dst *data) {}
+
+func (d *data) raceDropTargets() {}
+
+// casTarget stores ptr at target with an atomic compare-and-swap operation, if
+// it contains old, and reports whether it has been stored.
+func (d *data) casTarget(target *unsafe.Pointer, old, ptr unsafe.Pointer) bool {
+	return atomic.CompareAndSwapUintptr(
+		(*uintptr)(unsafe.Pointer(target)), uintptr(old), uintptr(ptr))
+}
@@ -0,0 +1,48 @@
+//go:build go1.18
+// +build go1.18
+
+package ptrguard
+
+import "unsafe"
+
+// PinPtr is the same as `Pin()`, but it only accepts pointers, so that the type
+// of the argument is checked at compile time instead of at runtime, which also
+// avoids the reflection overhead. Since methods can't have type parameters, the
+// Pinner is passed as the first argument.
+func PinPtr[T any](p *Pinner, ptr *T) *Pinned {
+	return p.pin(unsafe.Pointer(ptr))
+}
+
+// PinSlice pins the backing array of s and returns a Pinned value of a pointer
+// to its first element. The whole backing array stays alive until `Unpin()` is
+// called. For an empty slice there is nothing to pin, so a no-op Pinned is
+// returned, that stores nil, like with `PinBytes()`.
+func PinSlice[T any](p *Pinner, s []T) *Pinned {
+	if len(s) == 0 {
+		return &Pinned{}
+	}
+	return p.pin(unsafe.Pointer(&s[0]))
+}
+
+// PinMapValues pins the values referenced by the pointers in m, e.g. when they
+// are passed to C, and returns their Pinned values in the iteration order of
+// the map, which is unspecified. Only the values are pinned, not the internal
+// memory of the map, so the map itself must not be passed to C. Nil pointers
+// are skipped. Since methods can't have type parameters, the Pinner is passed
+// as the first argument.
+func PinMapValues[K comparable, V any](p *Pinner, m map[K]*V) []*Pinned {
+	pinned := make([]*Pinned, 0, len(m))
+	for _, v := range m {
+		if v != nil {
+			pinned = append(pinned, p.pin(unsafe.Pointer(v)))
+		}
+	}
+	return pinned
+}
+
+// StoreTo is the same as `Store()`, but the type of target is checked at compile
+// time, e.g. for a field of a C struct with a known pointer type. For a target
+// of type *unsafe.Pointer use `StorePointer()`.
+func StoreTo[T any](p *Pinned, target **T) {
+	p.StorePointer((*unsafe.Pointer)(unsafe.Pointer(target)))
+}
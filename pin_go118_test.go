@@ -0,0 +1,126 @@
+//go:build go1.18 && cgo
+// +build go1.18,cgo
+
+package ptrguard_test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/ansiwen/ptrguard"
+	C "github.com/ansiwen/ptrguard/internal/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinPtr(t *testing.T) {
+	tr := newTracer()
+	cPtr := (*unsafe.Pointer)(C.Malloc(ptrSize))
+	defer C.Free(unsafe.Pointer(cPtr))
+	var pg ptrguard.Pinner
+	ptrguard.PinPtr(&pg, tr.p).Store(cPtr)
+	assert.Equal(t, unsafe.Pointer(tr.p), *cPtr)
+	assert.Equal(t, "Pinner{pinned:1, stored:1}", pg.String())
+	tr.p = nil
+	runtime.GC()
+	runtime.GC()
+	assert.False(t, tr.finalized())
+	pg.Unpin()
+	assert.Zero(t, *cPtr)
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return tr.finalized() },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestStoreTo(t *testing.T) {
+	cSlot := (**int)(C.Malloc(ptrSize))
+	defer C.Free(unsafe.Pointer(cSlot))
+	cPtr := (*unsafe.Pointer)(C.Malloc(ptrSize))
+	defer C.Free(unsafe.Pointer(cPtr))
+	var pg ptrguard.Pinner
+	x := new(int)
+	pinned := ptrguard.PinPtr(&pg, x)
+	ptrguard.StoreTo(pinned, cSlot)
+	pinned.StorePointer(cPtr)
+	assert.Equal(t, x, *cSlot)
+	assert.Equal(t, unsafe.Pointer(x), *cPtr)
+	assert.Equal(t, "Pinner{pinned:1, stored:2}", pg.String())
+	pg.Unpin()
+	assert.Nil(t, *cSlot)
+	assert.Zero(t, *cPtr)
+}
+
+func TestPinSlice(t *testing.T) {
+	cPtr := (*unsafe.Pointer)(C.Malloc(ptrSize))
+	defer C.Free(unsafe.Pointer(cPtr))
+	var pg ptrguard.Pinner
+	s := make([]int64, 16)
+	ptrguard.PinSlice(&pg, s[4:]).Store(cPtr)
+	assert.Equal(t, unsafe.Pointer(&s[4]), *cPtr)
+	assert.Equal(t, 1, pg.Len())
+	for _, s := range [][]int64{nil, {}, s[:0]} {
+		ptrguard.PinSlice(&pg, s).Store(cPtr)
+		assert.Zero(t, *cPtr)
+	}
+	assert.Equal(t, 1, pg.Len())
+	pg.Unpin()
+}
+
+func TestPinMapValues(t *testing.T) {
+	m := map[string]*string{"nil": nil}
+	var trs [8]tracer
+	for i := range trs {
+		trs[i] = newTracer()
+		m[string(rune('a'+i))] = trs[i].p
+		trs[i].p = nil
+	}
+	var pg ptrguard.Pinner
+	pinned := ptrguard.PinMapValues(&pg, m)
+	assert.Len(t, pinned, len(trs))
+	assert.Equal(t, len(trs), pg.Len())
+	values := make(map[unsafe.Pointer]bool)
+	for _, v := range m {
+		values[unsafe.Pointer(v)] = true
+	}
+	for _, pp := range pinned {
+		assert.True(t, values[pp.Pointer()])
+	}
+	values = nil
+	m = nil
+	runtime.GC()
+	runtime.GC()
+	for i := range trs {
+		assert.False(t, trs[i].finalized())
+	}
+	pg.Unpin()
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool {
+		for i := range trs {
+			if !trs[i].finalized() {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func BenchmarkPinReflect(b *testing.B) {
+	var pg ptrguard.Pinner
+	x := new(int)
+	for i := 0; i < b.N; i++ {
+		pg.Pin(x)
+	}
+	pg.Unpin()
+}
+
+func BenchmarkPinGeneric(b *testing.B) {
+	var pg ptrguard.Pinner
+	x := new(int)
+	for i := 0; i < b.N; i++ {
+		ptrguard.PinPtr(&pg, x)
+	}
+	pg.Unpin()
+}
@@ -0,0 +1,41 @@
+package ptrguard
+
+import "sync"
+
+var pinnerPool sync.Pool
+
+// GetPinner returns a Pinner from a pool of unpinned Pinners, or a new one, if
+// the pool is empty. Other than a Pinner kept in a plain sync.Pool, it remembers
+// the recent peak of stored pointers recorded by PutPinner(), and pre-allocates
+// room for as many, when it starts pinning. This avoids the repeated
+// reallocations for repeating workloads, without the need of a capacity hint
+// like for NewPinner().
+func GetPinner() *Pinner {
+	if p, ok := pinnerPool.Get().(*Pinner); ok {
+		return p
+	}
+	return &Pinner{}
+}
+
+// PutPinner unpins the Pinner p like `Unpin()` and returns it to the pool of
+// GetPinner(). It records the number of pointers, that are stored at that time,
+// as the new peak, if it exceeds the previous one, which otherwise decays by
+// half, so that a Pinner adapts to a smaller workload after some cycles. The
+// Pinner must not be used anymore after PutPinner().
+func PutPinner(p *Pinner) {
+	p.retire()
+	pinnerPool.Put(p)
+}
+
+// retire unpins the Pinner and updates its peak of stored pointers.
+func (p *Pinner) retire() {
+	stored := p.StoredCount()
+	p.Unpin()
+	p.init()
+	p.instance.mtx.Lock()
+	p.peakRefs /= 2
+	if stored > p.peakRefs {
+		p.peakRefs = stored
+	}
+	p.instance.mtx.Unlock()
+}
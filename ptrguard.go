@@ -4,25 +4,52 @@
 package ptrguard
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"runtime"
+	"runtime/pprof"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 // Pinner can pin Go objects (in memory allocated by Go runtime) with the Pin()
 // method. A pinned pointer to these objects can be stored in C memory
 // (allocated by malloc) with the `Store()` method. All pinned objects of a
-// Pinner can be unpinned with the `Unpin()` method.
+// Pinner can be unpinned with the `Unpin()` method. A single Pinner can be
+// shared by several go routines, that pin and store concurrently, but
+// `Unpin()` must not be called before all of them are done.
 type Pinner struct {
 	*instance
 }
 
 // Pinned pointer that can be stored with the Store() method.
 type Pinned struct {
-	ptr  unsafe.Pointer
-	data *data
+	ptr      unsafe.Pointer
+	obj      unsafe.Pointer // object kept by the keeper for this pin, if any
+	data     *data
+	stored   int
+	targets  []*unsafe.Pointer // targets stored by this Pinned value
+	released bool              // whether Unpin() has been called
+	// closed when the object is released by Unpin(), created on demand by
+	// WaitReleased()
+	done  chan struct{}
+	site  string    // calling function of the pin in validation mode
+	stack []uintptr // call stack of the pin in debug mode
+}
+
+// NewPinner returns a new Pinner, that pre-allocates room for capacityHint
+// stored pointers, whenever it starts pinning, e.g. after each `Unpin()`. This
+// avoids the repeated reallocations, when the number of stores is known in
+// advance, like for an iovec array. The zero Pinner is ready to use as well.
+func NewPinner(capacityHint int) *Pinner {
+	p := &Pinner{}
+	p.init()
+	p.capHint = capacityHint
+	return p
 }
 
 // Pin the Go object referenced by pointer and return a Pinned value. The
@@ -35,49 +62,1265 @@ type Pinned struct {
 //
 // [1] https://golang.org/cmd/cgo/#hdr-Passing_pointers
 func (p *Pinner) Pin(pointer interface{}) *Pinned {
-	if p.instance == nil {
-		p.instance = &instance{}
-		runtime.SetFinalizer(p.instance, func(i *instance) {
-			if i.data != nil {
-				leakPanic()
-			}
+	pinned, err := p.TryPin(pointer)
+	if err != nil {
+		panic(err)
+	}
+	return pinned
+}
+
+// TryPin is the same as Pin(), but instead of panicking it returns a
+// *NotPointerError, if pointer is not a pointer. In this case nothing is
+// pinned.
+func (p *Pinner) TryPin(pointer interface{}) (*Pinned, error) {
+	ptr, err := getPtr(pointer)
+	if err != nil {
+		return nil, err
+	}
+	return p.pin(ptr), nil
+}
+
+// PinValue is the same as Pin(), but it takes the pointer as reflect.Value, which
+// must be of kind Ptr or UnsafePointer, otherwise PinValue() panics. This avoids
+// wrapping a reflect.Value, e.g. of a serialization library, into an interface
+// just to be unwrapped again.
+func (p *Pinner) PinValue(v reflect.Value) *Pinned {
+	pinned, err := p.TryPinValue(v)
+	if err != nil {
+		panic(err)
+	}
+	return pinned
+}
+
+// TryPinValue is the same as PinValue(), but instead of panicking it returns a
+// *NotPointerError, if v is not a pointer. In this case nothing is pinned.
+func (p *Pinner) TryPinValue(v reflect.Value) (*Pinned, error) {
+	ptr, err := getValuePtr(v)
+	if err != nil {
+		return nil, err
+	}
+	return p.pin(ptr), nil
+}
+
+// PinAll pins all objects referenced by pointers like Pin() and returns their
+// Pinned values in the same order. If any of the arguments is not a pointer,
+// PinAll() panics with an error identifying its index, and nothing is pinned.
+func (p *Pinner) PinAll(pointers ...interface{}) []*Pinned {
+	pinned, err := p.TryPinAll(pointers...)
+	if err != nil {
+		panic(err)
+	}
+	return pinned
+}
+
+// TryPinAll is the same as PinAll(), but instead of panicking it returns an
+// error wrapping the *NotPointerError of the first argument, that is not a
+// pointer. In this case nothing is pinned.
+func (p *Pinner) TryPinAll(pointers ...interface{}) ([]*Pinned, error) {
+	ptrs := make([]unsafe.Pointer, len(pointers))
+	for i, pointer := range pointers {
+		ptr, err := getPtr(pointer)
+		if err != nil {
+			return nil, fmt.Errorf("ptrguard: argument %d: %w", i, err)
+		}
+		ptrs[i] = ptr
+	}
+	return p.pinAll(ptrs), nil
+}
+
+// PinAndStoreSlice pins all objects referenced by objs like PinAll() and stores
+// the pinned pointers in consecutive elements of a C array at base, whose
+// elements are elemSize bytes apart, e.g. in the Base fields of an iovec array.
+// Like with Store(), the elements are zeroed by `Unpin()`. There must be room
+// for len(objs) elements. If any of the objects is not a pointer, if base is nil
+// or if elemSize is smaller than a pointer, PinAndStoreSlice() panics, and
+// nothing is pinned.
+func (p *Pinner) PinAndStoreSlice(objs []interface{}, base unsafe.Pointer, elemSize uintptr) {
+	if len(objs) == 0 {
+		return
+	}
+	switch {
+	case base == nil:
+		panic("ptrguard: C array base is nil")
+	case elemSize < unsafe.Sizeof(base):
+		panic(fmt.Sprintf("ptrguard: C array element size %d is smaller than "+
+			"a pointer", elemSize))
+	}
+	for i, pinned := range p.PinAll(objs...) {
+		pinned.StoreInArray(base, i, elemSize)
+	}
+}
+
+func (p *Pinner) pin(ptr unsafe.Pointer) *Pinned {
+	data := p.lockData(true)
+	if foreignPointerMode != ForeignPointerIgnore && skipPin(ptr) {
+		data.mtx.Unlock()
+		return &Pinned{ptr: ptr, data: data}
+	}
+	// Hand ptr over to the keeper of the Pinner, that keeps it reachable until
+	// Unpin() is called.
+	data.keep(ptr)
+	var stack []uintptr
+	if debug {
+		stack = callers()
+	}
+	pinned := data.track(ptr, ptr, stack)
+	data.mtx.Unlock()
+	if onPin != nil {
+		onPin(ptr)
+	}
+	return pinned
+}
+
+// pinAll is like pin() for all ptrs, but the objects are handed over to the
+// keeper at once, which allows the keeper to pin them more efficiently.
+func (p *Pinner) pinAll(ptrs []unsafe.Pointer) []*Pinned {
+	data := p.lockData(true)
+	pinned := make([]*Pinned, len(ptrs))
+	kept := make([]unsafe.Pointer, 0, len(ptrs))
+	for i, ptr := range ptrs {
+		if foreignPointerMode != ForeignPointerIgnore && skipPin(ptr) {
+			pinned[i] = &Pinned{ptr: ptr, data: data}
+			continue
+		}
+		kept = append(kept, ptr)
+	}
+	data.keepAll(kept)
+	var stack []uintptr
+	if debug {
+		stack = callers()
+	}
+	for i, ptr := range ptrs {
+		if pinned[i] == nil {
+			pinned[i] = data.track(ptr, ptr, stack)
+		}
+	}
+	data.mtx.Unlock()
+	if onPin != nil {
+		for _, ptr := range kept {
+			onPin(ptr)
+		}
+	}
+	return pinned
+}
+
+// track records a new pin of the object obj, that has been handed over to the
+// keeper, and returns its Pinned value of ptr, which points to obj or into it.
+// The stack of the pin is only recorded in debug mode.
+func (d *data) track(ptr, obj unsafe.Pointer, stack []uintptr) *Pinned {
+	d.pinned++
+	d.countPin()
+	d.ptrs = append(d.ptrs, obj)
+	pinned := &Pinned{ptr: ptr, obj: obj, data: d, stack: stack}
+	if validateCallSites {
+		pinned.site = callSite().Function
+	}
+	d.pins = append(d.pins, pinned)
+	return pinned
+}
+
+// MustPin is the same as Pin(). It can be used to make explicit at the call
+// site, that it panics if pointer is not a pointer.
+func (p *Pinner) MustPin(pointer interface{}) *Pinned {
+	return p.Pin(pointer)
+}
+
+// PinAutoRelease pins the Go object referenced by pointer like Pin(), but the
+// object is additionally released automatically, as soon as the returned
+// Pinned value becomes unreachable and has been finalized by the garbage
+// collector, like with `Pinned.Unpin()`. No `Unpin()` call is needed for it. It
+// is still released by `Unpin()` of the Pinner, if that comes first, so a
+// Pinner, that is used for such pins, must not be leaked, e.g. a long-lived one,
+// that is never unpinned. The Pinned value is not included in Pins(), and after
+// Merge() the object is only released by the merging Pinner.
+//
+// WARNING: This is only a last resort for code paths, that really can't know
+// when C is done with the pointer, e.g. when the pointer is handed to a third
+// party C library without a completion callback. The garbage collector doesn't
+// know about C memory, so C might still hold and use the pointer after it has
+// been released, which leads to memory corruption. Stored pointers are zeroed
+// when the object is released, but that can happen at any time after the last
+// use of the Pinned value, so keep it reachable, e.g. with runtime.KeepAlive(),
+// as long as C uses the pointer.
+func (p *Pinner) PinAutoRelease(pointer interface{}) *Pinned {
+	pinned := p.Pin(pointer)
+	// The Pinned value must not be kept reachable by the Pinner, otherwise it
+	// is never finalized.
+	data := pinned.lock()
+	data.pins = removePinnedValue(data.pins, pinned)
+	data.mtx.Unlock()
+	runtime.SetFinalizer(pinned, (*Pinned).Unpin)
+	return pinned
+}
+
+// PinRaw is the bare pinning primitive beneath the Pinner: it keeps the Go
+// object referenced by ptr alive in a background go routine until the returned
+// release function is called, without any of the bookkeeping of a Pinner. There
+// is no leak detection, no foreign pointer check and no tracking of stored
+// pointers, so the caller is fully responsible for calling release, and for not
+// using the pointer in C any longer afterwards. Calling release more than once
+// has no effect. The ptr must be a pointer of any type or unsafe.Pointer,
+// otherwise PinRaw() panics.
+func PinRaw(ptr interface{}) (release func()) {
+	p, err := getPtr(ptr)
+	if err != nil {
+		panic(err)
+	}
+	pins := make(chan pinOp)
+	done := make(chan struct{})
+	goPinUntilRelease(pins, done, false)
+	pins <- pinOp{ptr: p}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(pins)
+			<-done
 		})
 	}
-	if p.data == nil {
-		p.data = &data{}
-		p.release.Lock()
+}
+
+// PinNoCheck pins the object referenced by ptr like Pin() and calls fn with its
+// address, while cgocheck is disabled like with NoCheck(), e.g. to store the
+// address in Go memory, that is passed to a C function by fn. cgocheck is
+// restored, even if fn panics. The object stays pinned after fn has returned,
+// until `Unpin()` is called on the Pinner. The ptr must be a pointer of any type
+// or unsafe.Pointer, otherwise PinNoCheck() panics.
+func (p *Pinner) PinNoCheck(ptr interface{}, fn func(p uintptr)) {
+	pinned := p.Pin(ptr)
+	NoCheck(func() {
+		fn(pinned.Uintptr())
+	})
+}
+
+// PinCall keeps the Go object referenced by ptr alive, while fn is called with
+// its address, e.g. to pass a buffer to a single C function. No Pinner and no
+// background go routine is involved, so there is nothing to unpin afterwards,
+// and nothing can leak. The address must not be used by C after fn has
+// returned. The ptr must be a pointer of any type or unsafe.Pointer, otherwise
+// PinCall() panics.
+func PinCall(ptr interface{}, fn func(p uintptr)) {
+	p, err := getPtr(ptr)
+	if err != nil {
+		panic(err)
 	}
-	data := p.data
-	ptr := getPtr(pointer)
-	var pinned sync.Mutex
-	pinned.Lock()
-	// Start a background go routine that lives until Unpin() is called. This
-	// calls a special function that makes sure the garbage collector doesn't
-	// touch ptr and then waits until it receives the "release" signal, after
-	// which it exits.
-	data.wg.Add(1)
-	go func() {
-		pinUntilRelease(&pinned, &data.release, uintptr(ptr))
-		data.wg.Done()
-	}()
-	pinned.Lock() // wait for the "pinned" signal from the go routine.
-	return &Pinned{ptr, data}
+	callPinned(uintptr(p), fn)
+}
+
+// WithPinned keeps the Go objects referenced by ptrs alive, while fn is called,
+// e.g. for buffers, that are referenced by an iovec array passed to a single C
+// function. Like with PinCall(), nothing is left to unpin afterwards. If any of
+// the elements of ptrs is not a pointer, WithPinned() panics with an error
+// identifying its index before fn is called.
+func WithPinned(ptrs []interface{}, fn func()) {
+	addrs := make([]unsafe.Pointer, len(ptrs))
+	for i, ptr := range ptrs {
+		addr, err := getPtr(ptr)
+		if err != nil {
+			panic(fmt.Errorf("ptrguard: argument %d: %w", i, err))
+		}
+		addrs[i] = addr
+	}
+	fn()
+	runtime.KeepAlive(addrs)
+}
+
+// callPinned calls fn with p. Since p is converted from a pointer in the
+// argument list of the call, the compiler keeps the object alive until
+// callPinned() returns.
+//
+//go:uintptrescapes
+//go:noinline
+func callPinned(p uintptr, fn func(p uintptr)) {
+	fn(p)
+}
+
+// PinContext pins the Go object referenced by ctxPtr, like a context struct of a
+// callback registered with C, and returns its address, that can be passed to C
+// as the opaque argument of the callback. The object stays alive until
+// `Unpin()` is called. The ctxPtr must be a pointer of any type or
+// unsafe.Pointer, otherwise PinContext() panics.
+func (p *Pinner) PinContext(ctxPtr interface{}) unsafe.Pointer {
+	return p.Pin(ctxPtr).ptr
+}
+
+// Swap pins the Go object referenced by newPtr and atomically stores the pinned
+// pointer at slot, which is zeroed by `Unpin()` like with `Store()`. If a
+// pointer has been stored at slot by a previous Swap() of the Pinner, its
+// Pinned value is unpinned like with `Pinned.Unpin()`, so that a C slot can be
+// switched between objects, e.g. for double-buffering, without keeping the
+// previous ones pinned. The slot is only zeroed by `Unpin()` of the Pinned value
+// of the last Swap() for it. The newPtr must be a pointer of any type or
+// unsafe.Pointer, otherwise Swap() panics.
+func (p *Pinner) Swap(slot *unsafe.Pointer, newPtr interface{}) *Pinned {
+	pinned := p.Pin(newPtr)
+	data := pinned.lock()
+	defer data.mtx.Unlock()
+	prev := data.swapped[slot]
+	// The registration of the slot is moved from the previous Pinned value to
+	// the new one, so that it is not zeroed, when the previous object is
+	// released. Otherwise the slot is reserved before anything is stored, since
+	// the checks may panic.
+	moved := prev != nil && prev.removeTarget(slot)
+	if !moved {
+		pinned.reserveLocked(slot)
+	}
+	atomic.StoreUintptr((*uintptr)(unsafe.Pointer(slot)), uintptr(pinned.ptr))
+	if data.swapped == nil {
+		data.swapped = make(map[*unsafe.Pointer]*Pinned)
+	}
+	data.swapped[slot] = pinned
+	if moved {
+		pinned.targets = append(pinned.targets, slot)
+		pinned.stored++
+	} else {
+		pinned.addLocked(slot, true)
+	}
+	if prev != nil {
+		prev.unpinLocked()
+	}
+	return pinned
+}
+
+// PinBytes pins the backing array of the byte slice b and returns a Pinned value
+// of a pointer to its first element. Any type with the underlying type []byte,
+// like json.RawMessage, can be passed as well. For a nil or empty slice there is
+// nothing to pin, and a no-op Pinned value is returned, whose Pointer() is nil
+// and that stores nil.
+func (p *Pinner) PinBytes(b []byte) *Pinned {
+	if len(b) == 0 {
+		return &Pinned{}
+	}
+	pinned := p.Pin(&b[0])
+	data := pinned.lock()
+	data.bytes += len(b)
+	data.mtx.Unlock()
+	return pinned
+}
+
+// PinString pins the bytes of the string s and returns a Pinned value of a
+// pointer to the first byte, e.g. to pass a Go string to C without copying it.
+// Go strings are not NUL-terminated, so the length must be passed as well. For
+// an empty string there is nothing to pin and a no-op Pinned is returned, that
+// stores nil.
+func (p *Pinner) PinString(s string) *Pinned {
+	if len(s) == 0 {
+		return &Pinned{}
+	}
+	return p.pin(stringData(s))
+}
+
+// PinSliceElements pins the backing array of slice, which must be a slice of any
+// type, otherwise PinSliceElements() panics. It returns a Pinned value of a
+// pointer to each element of the slice, e.g. for an array of structs, that is
+// mutated in place by C. Since all elements are kept alive by the backing
+// array, it is handed over to the backend only once, but each element counts
+// as a pin of it, so that the elements can be unpinned individually with
+// `Pinned.Unpin()`, and the array stays pinned, until all of them or the
+// Pinner are unpinned. For an empty slice nil is returned.
+func (p *Pinner) PinSliceElements(slice interface{}) []*Pinned {
+	val := reflect.ValueOf(slice)
+	if val.Kind() != reflect.Slice {
+		panic(fmt.Sprintf("%T is not a slice", slice))
+	}
+	if val.Len() == 0 {
+		return nil
+	}
+	base := unsafe.Pointer(val.Pointer())
+	pinned := make([]*Pinned, val.Len())
+	data := p.lockData(true)
+	skip := foreignPointerMode != ForeignPointerIgnore && skipPin(base)
+	var stack []uintptr
+	if debug && !skip {
+		stack = callers()
+	}
+	for i := range pinned {
+		elem := unsafe.Pointer(val.Index(i).UnsafeAddr())
+		if skip {
+			pinned[i] = &Pinned{ptr: elem, data: data}
+			continue
+		}
+		// The keeper pins the array only for the first element, for the
+		// others only its reference count is incremented.
+		data.keep(base)
+		pinned[i] = data.track(elem, base, stack)
+	}
+	data.mtx.Unlock()
+	if onPin != nil && !skip {
+		onPin(base)
+	}
+	return pinned
+}
+
+// Scope calls fn with a new Pinner and unpins it when fn returns. If fn panics,
+// the Pinner is unpinned before the panic propagates, so that it can't be
+// leaked.
+func Scope(fn func(p *Pinner)) {
+	var p Pinner
+	defer p.Unpin()
+	fn(&p)
+}
+
+// Do pins all objects referenced by ptrs like PinAll() with a new Pinner, calls
+// fn with their Pinned values in the same order, so that fn can store them in C
+// memory and make the C call, and unpins them when fn returns. If fn panics,
+// the objects are unpinned before the panic propagates. If any of the elements
+// of ptrs is not a pointer, Do() panics with an error identifying its index,
+// and neither anything is pinned nor fn is called.
+func Do(ptrs []interface{}, fn func(pins []*Pinned)) {
+	var p Pinner
+	defer p.Unpin()
+	fn(p.PinAll(ptrs...))
+}
+
+// WithPinnedRetry pins all pointers in ptrs with `Pin()` once and then calls
+// call in a loop as long as it returns true, e.g. for a C function that fails
+// with EINTR or EAGAIN and must be retried with the same buffers. After the loop
+// has ended, or if call panics, `Unpin()` is called on the Pinner, so that the
+// objects stay pinned across all retries without being unpinned and pinned
+// again for each of them.
+func (p *Pinner) WithPinnedRetry(ptrs []interface{}, call func() (retry bool)) {
+	defer p.Unpin()
+	for _, ptr := range ptrs {
+		p.Pin(ptr)
+	}
+	for call() {
+	}
+}
+
+// PinnedBytes returns the total length of all buffers pinned with PinBytes()
+// since the last `Unpin()`. Objects pinned with other methods are not counted,
+// since their size is unknown. This allows to limit how much memory is kept
+// pinned, e.g. for in-flight I/O.
+func (p *Pinner) PinnedBytes() int {
+	data := p.lockData(false)
+	if data == nil {
+		return 0
+	}
+	defer data.mtx.Unlock()
+	return data.bytes
 }
 
 // Unpin all pinned objects of the Pinner and zero all memory where the pointer
 // has been stored. Whenever Pin() has been called at least once on a Pinner,
 // Unpin() must be called afterwards on the same Pinner, or the garbage
 // collector thread will panic.
+//
+// All targets are zeroed before any of the objects is released, so as long as
+// C reads a pinned pointer from a target, even concurrently to Unpin(), the
+// object is still pinned. It is never the other way around, i.e. an object is
+// never released, while a pointer to it is still stored in a target. For C
+// threads, that read targets concurrently, the pointers should be stored with
+// StoreAtomic(), so that they are also zeroed atomically.
 func (p *Pinner) Unpin() {
-	unpin(p.instance)
+	if validateCallSites && p.instance != nil && p.data != nil {
+		p.checkCallSites(callSite().Function)
+	}
+	unpin(p.instance, false)
+}
+
+// SetAutoUnpin starts a timer, that calls `Unpin()` on the Pinner after d, unless
+// it has been unpinned before. This bounds the time objects stay pinned, if a
+// code path forgets to call `Unpin()`, but as with a late `Unpin()`, C must not
+// use the pointers anymore at that point. The timer applies only to the current
+// pins: it is stopped by `Unpin()`, and it must be started again, when the
+// Pinner is reused. Calling SetAutoUnpin() again replaces the timer.
+func (p *Pinner) SetAutoUnpin(d time.Duration) {
+	data := p.lockData(true)
+	defer data.mtx.Unlock()
+	if data.autoUnpin != nil {
+		data.autoUnpin.Stop()
+	}
+	inst := p.instance
+	data.autoUnpin = time.AfterFunc(d, func() {
+		// The Pinner might have been unpinned and reused meanwhile.
+		unpinData(inst, data, false)
+	})
+}
+
+// Reset unpins all pinned objects of the Pinner like `Unpin()`, and also
+// forgets how many pointers have been stored before, as recorded by
+// PutPinner() to pre-allocate room for the stored pointers, when the Pinner is
+// reused for a similar workload. After Reset() the Pinner is like a new one,
+// apart from the limit set with SetMaxStoredRefs() and the capacity hint of
+// NewPinner(), e.g. when a Pinner of GetPinner() is used for a different kind
+// of work. Resetting an uninitialized or unpinned Pinner only forgets the
+// stored pointers count.
+func (p *Pinner) Reset() {
+	p.Unpin()
+	if p.instance == nil {
+		return
+	}
+	p.instance.mtx.Lock()
+	p.peakRefs = 0
+	p.instance.mtx.Unlock()
+}
+
+// UnpinAsync is like `Unpin()`, but it doesn't wait until all pinned objects
+// have actually been released, and functions registered with Absorb() are
+// called in the background. Stored pointers are zeroed before it returns, and
+// the Pinner can be reused immediately. Draining() reports whether releasing
+// is still in progress.
+func (p *Pinner) UnpinAsync() {
+	if validateCallSites && p.instance != nil && p.data != nil {
+		p.checkCallSites(callSite().Function)
+	}
+	unpin(p.instance, true)
+}
+
+// UnpinContext is like `Unpin()`, but it waits only until ctx is done for the
+// pinned objects to be released and the functions registered with Absorb() to
+// return. In this case it returns ctx.Err(), and the release is completed in
+// the background, like with UnpinAsync(). Stored pointers are zeroed before it
+// returns in any case. This allows to bound the latency of the cleanup, e.g. if
+// a free function of Absorb() blocks.
+func (p *Pinner) UnpinContext(ctx context.Context) error {
+	if validateCallSites && p.instance != nil && p.data != nil {
+		p.checkCallSites(callSite().Function)
+	}
+	unpin(p.instance, true)
+	draining := p.drainingChan()
+	if draining == nil {
+		return nil
+	}
+	select {
+	case <-draining:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Active reports whether the Pinner has to be unpinned, i.e. whether it has
+// been used by Pin() or a similar method since it has been created or unpinned
+// the last time, even if all its pins have been released individually with
+// `Pinned.Unpin()`. This allows wrapper code to decide whether cleanup is needed.
+// It returns false for an uninitialized Pinner.
+func (p *Pinner) Active() bool {
+	data := p.lockData(false)
+	if data == nil {
+		return false
+	}
+	data.mtx.Unlock()
+	return true
+}
+
+// Draining reports whether the objects of the last unpin of the Pinner are
+// still in the process of being released, which can be the case after
+// UnpinAsync(). It returns false for a settled Pinner.
+func (p *Pinner) Draining() bool {
+	draining := p.drainingChan()
+	if draining == nil {
+		return false
+	}
+	select {
+	case <-draining:
+		return false
+	default:
+		return true
+	}
+}
+
+// drainingChan returns the drained channel of the last unpin of the Pinner, or
+// nil if it has never been unpinned.
+func (p *Pinner) drainingChan() chan struct{} {
+	if atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&p.instance))) == nil {
+		return nil
+	}
+	p.instance.mtx.Lock()
+	defer p.instance.mtx.Unlock()
+	return p.draining
 }
 
 // Store a pinned pointer at target. Target must be a pointer to a pointer of
-// any type or a pointer to unsafe.Pointer, otherwise Store() panics.
+// any type or a pointer to unsafe.Pointer, otherwise Store() panics. It panics
+// with ErrStoreAfterUnpin as well, if the pinned pointer has already been
+// unpinned, because then the stored pointer would be dangling. In debug mode,
+// see SetDebug(), Store() additionally verifies, that the object is still kept
+// alive by the Pinner, and otherwise panics with a *StalePointerError, which
+// catches e.g. stores of copied Pinned values. These checks can't detect
+// whether the pinned object is still the one the caller intends to store, e.g.
+// after the variable it was pinned from has been reassigned, since the object
+// stays pinned anyway.
 func (p *Pinned) Store(target interface{}) {
-	ptrPtr := getPtrPtr(target)
-	*hiddenPtr(ptrPtr) = *hiddenPtr(&p.ptr)
-	p.data.add(ptrPtr)
+	if err := p.TryStore(target); err != nil {
+		panic(err)
+	}
+}
+
+// TryStore is the same as Store(), but instead of panicking it returns a
+// *NotPointerToPointerError, if target is not a pointer to a pointer, e.g. to
+// validate storage locations supplied by a caller. In this case nothing is
+// stored. It still panics with ErrStoreAfterUnpin, since that is a bug of the
+// calling code and not of the target.
+func (p *Pinned) TryStore(target interface{}) error {
+	ptrPtr, err := getPtrPtr(target)
+	if err != nil {
+		return err
+	}
+	p.StorePointer(ptrPtr)
+	return nil
+}
+
+// StoreAll stores the pinned pointer at each of the targets like Store(), which
+// are all zeroed by `Unpin()`. If any of the targets is not a pointer to a
+// pointer, StoreAll() panics with an error identifying its index, and nothing is
+// stored.
+func (p *Pinned) StoreAll(targets ...interface{}) {
+	ptrPtrs := make([]*unsafe.Pointer, len(targets))
+	for i, target := range targets {
+		ptrPtr, err := getPtrPtr(target)
+		if err != nil {
+			panic(fmt.Errorf("ptrguard: target %d: %w", i, err))
+		}
+		ptrPtrs[i] = ptrPtr
+	}
+	for _, ptrPtr := range ptrPtrs {
+		p.StorePointer(ptrPtr)
+	}
+}
+
+// StorePointer is the same as `Store()` for a target of type *unsafe.Pointer,
+// that doesn't need to be checked with reflection.
+func (p *Pinned) StorePointer(target *unsafe.Pointer) {
+	checkStoreTarget(target)
+	p.register(target, false)
+	*hiddenPtr(target) = *hiddenPtr(&p.ptr)
+}
+
+// StoreAtomic is the same as `StorePointer()`, but the pinned pointer is stored
+// with an atomic operation, and target is zeroed atomically by `Unpin()` as
+// well. This prevents torn reads, when C reads target concurrently, e.g. when
+// it polls the slot. Like with Swap(), the pointer is stored as uintptr, so that
+// the store is not checked by cgocheck.
+func (p *Pinned) StoreAtomic(target *unsafe.Pointer) {
+	checkStoreTarget(target)
+	p.register(target, true)
+	atomic.StoreUintptr((*uintptr)(unsafe.Pointer(target)), uintptr(p.ptr))
+}
+
+// Swap is the same as Store(), but it returns the pointer, that has been at
+// target before, e.g. to free previously stored C memory. Like with Store(),
+// target is zeroed by `Unpin()`. The swap is not atomic, see StoreCAS() for
+// slots, that are accessed by C concurrently.
+func (p *Pinned) Swap(target interface{}) unsafe.Pointer {
+	ptrPtr, err := getPtrPtr(target)
+	if err != nil {
+		panic(err)
+	}
+	var prev unsafe.Pointer
+	*hiddenPtr(&prev) = *hiddenPtr(ptrPtr)
+	p.StorePointer(ptrPtr)
+	return prev
+}
+
+// StoreCAS stores the pinned pointer at target with an atomic compare-and-swap
+// operation, only if target currently contains old, and reports whether it has
+// been stored. This allows to safely insert pinned pointers into lock-free
+// slots shared with C. Only if it has been stored, target is zeroed by
+// `Unpin()`.
+func (p *Pinned) StoreCAS(target *unsafe.Pointer, old unsafe.Pointer) bool {
+	checkStoreTarget(target)
+	data := p.lock()
+	if data == nil {
+		return atomic.CompareAndSwapUintptr(
+			(*uintptr)(unsafe.Pointer(target)), uintptr(old), uintptr(p.ptr))
+	}
+	defer data.mtx.Unlock()
+	// Check before the swap, so that no pointer is left in target, that isn't
+	// zeroed by Unpin(), if a check panics.
+	p.checkStore()
+	data.checkLimit()
+	if !data.casTarget(target, old, p.ptr) {
+		return false
+	}
+	p.addLocked(target, true)
+	return true
+}
+
+// StoreField stores the pinned pointer in the field fieldName of a struct at
+// cbase in C memory, that has the memory layout of the Go struct type
+// structType. The field must be of a pointer type or unsafe.Pointer, otherwise
+// StoreField() panics.
+func (p *Pinned) StoreField(cbase unsafe.Pointer, structType reflect.Type, fieldName string) {
+	field, ok := structType.FieldByName(fieldName)
+	if !ok || len(field.Index) != 1 {
+		panic(fmt.Sprintf("%s has no field %s", structType, fieldName))
+	}
+	if k := field.Type.Kind(); k != reflect.Ptr && k != reflect.UnsafePointer {
+		panic(fmt.Sprintf("field %s of %s is not a pointer", fieldName, structType))
+	}
+	p.StoreAtOffset(cbase, field.Offset)
+}
+
+// StoreStructField is like StoreField(), but the struct is given by structPtr,
+// which must be a pointer to a struct, e.g. to a Go struct mirroring a C struct,
+// or to C memory converted to such a struct type. The field fieldName must be of
+// a pointer type or unsafe.Pointer. Otherwise StoreStructField() panics.
+func (p *Pinned) StoreStructField(structPtr interface{}, fieldName string) {
+	val := reflect.ValueOf(structPtr)
+	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("%T is not a pointer to a struct", structPtr))
+	}
+	p.StoreField(unsafe.Pointer(val.Pointer()), val.Elem().Type(), fieldName)
+}
+
+// StoreAtOffset stores the pinned pointer at offset bytes from base in C memory,
+// e.g. in a field of an opaque C struct with a manually computed layout. Like
+// with Store(), the target is zeroed by `Unpin()`.
+func (p *Pinned) StoreAtOffset(base unsafe.Pointer, offset uintptr) {
+	p.StorePointer((*unsafe.Pointer)(unsafe.Pointer(uintptr(base) + offset)))
+}
+
+// StoreInArray stores the pinned pointer in the element index of a C array at
+// base, whose elements are elemSize bytes apart, e.g. in the first field of an
+// array of C structs. Like with Store(), the element is zeroed by `Unpin()`. If
+// index is negative, StoreInArray() panics.
+func (p *Pinned) StoreInArray(base unsafe.Pointer, index int, elemSize uintptr) {
+	if index < 0 {
+		panic(fmt.Sprintf("ptrguard: negative array index %d", index))
+	}
+	p.StoreAtOffset(base, uintptr(index)*elemSize)
+}
+
+// FieldOffsets returns the offsets of all fields of the struct type structType
+// by their names, e.g. for computing the addresses of fields of a struct in C
+// memory, that has the memory layout of structType. If structType is not a
+// struct type, FieldOffsets() panics.
+func FieldOffsets(structType reflect.Type) map[string]uintptr {
+	if structType.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("%s is not a struct", structType))
+	}
+	offsets := make(map[string]uintptr, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		offsets[field.Name] = field.Offset
+	}
+	return offsets
+}
+
+// register target for zeroing by `Unpin()`, atomically if atomically is true.
+func (p *Pinned) register(target *unsafe.Pointer, atomically bool) {
+	data := p.lock()
+	if data == nil {
+		return
+	}
+	defer data.mtx.Unlock()
+	p.checkStore()
+	p.registerLocked(target, atomically)
+}
+
+// registerLocked does the work of register() with the mutex of the data
+// locked. Like register(), it must be called before target is written, since
+// the checks of reserveLocked() may panic.
+func (p *Pinned) registerLocked(target *unsafe.Pointer, atomically bool) {
+	p.reserveLocked(target)
+	p.addLocked(target, atomically)
+}
+
+// reserveLocked runs the checks, that may panic, before target is registered:
+// the limit of stored pointers and, with the race detector, the owner of
+// target, which is recorded for the Pinner. It must be called before target is
+// written, so that no pointer is left in target, that isn't zeroed by
+// `Unpin()`. If target isn't written after all, raceRemoveTarget() must be
+// called.
+func (p *Pinned) reserveLocked(target *unsafe.Pointer) {
+	p.data.checkLimit()
+	p.data.raceAddTarget(target)
+}
+
+// addLocked registers target, that has been reserved with reserveLocked(), for
+// zeroing by `Unpin()`. It doesn't panic.
+func (p *Pinned) addLocked(target *unsafe.Pointer, atomically bool) {
+	p.data.add(target, atomically)
+	p.targets = append(p.targets, target)
+	p.stored++
+	if storeLog != nil {
+		storeLog.record(target, p.ptr)
+	}
+}
+
+// checkStore panics, if the pinned pointer can't be stored anymore, because it
+// has been unpinned. In debug mode it also panics with a *StalePointerError, if
+// the object is not kept alive by the Pinner anymore, although the Pinned value
+// has not been unpinned, e.g. if it is a copy of an unpinned one. The mutex of
+// the data must be locked.
+func (p *Pinned) checkStore() {
+	if p.data.released || p.released {
+		panic(ErrStoreAfterUnpin)
+	}
+	if debug && p.obj != nil && p.data.counts[p.obj] == 0 {
+		panic(&StalePointerError{Ptr: p.ptr})
+	}
+}
+
+// Clear zeroes the target, where the pinned pointer has been stored before, and
+// removes it from the targets, that are zeroed by `Unpin()`, e.g. to reuse an
+// entry of an iovec array for another buffer. The object stays pinned. Target
+// must be a pointer to a pointer, like with Store(), otherwise Clear() panics.
+// It panics as well, if the pinned pointer has not been stored at target. After
+// `Unpin()` of the Pinner all targets are zeroed already, so Clear() has no
+// effect.
+func (p *Pinned) Clear(target interface{}) {
+	ptrPtr, err := getPtrPtr(target)
+	if err != nil {
+		panic(err)
+	}
+	if data := p.lock(); data != nil {
+		defer data.mtx.Unlock()
+		if data.released {
+			return
+		}
+	}
+	if p.removeTarget(ptrPtr) {
+		p.data.refs.zero(ptrPtr)
+		p.data.refs.remove(ptrPtr)
+		p.data.raceRemoveTarget(ptrPtr)
+		return
+	}
+	panic(fmt.Sprintf("ptrguard: pinned pointer %p has not been stored at %p",
+		p.ptr, ptrPtr))
+}
+
+// Unpin releases only the object of this pinned pointer and zeroes only the
+// targets it has been stored at, while all other pins of the Pinner stay intact.
+// If the object has been pinned several times, only one of the pins is
+// released. Calling Unpin() on a Pinned value, whose Pinner has already been
+// unpinned, or more than once, has no effect.
+func (p *Pinned) Unpin() {
+	if p.loadData() == nil {
+		return
+	}
+	if p.unpin() && onUnpin != nil {
+		onUnpin(1)
+	}
+}
+
+// removeTarget removes target from the targets of the Pinned value without
+// zeroing it, and reports whether it has been one. The mutex of the data must be
+// locked.
+func (p *Pinned) removeTarget(target *unsafe.Pointer) bool {
+	for i := range p.targets {
+		if p.targets[i] == target {
+			p.targets = append(p.targets[:i], p.targets[i+1:]...)
+			p.stored--
+			return true
+		}
+	}
+	return false
+}
+
+// unpin does the work of Unpin() and reports whether a pin has been released.
+func (p *Pinned) unpin() bool {
+	data := p.lock()
+	if data == nil {
+		return false
+	}
+	defer data.mtx.Unlock()
+	return p.unpinLocked()
+}
+
+// unpinLocked does the work of unpin() with the mutex of the data locked.
+func (p *Pinned) unpinLocked() bool {
+	if p.data.released {
+		return false
+	}
+	for _, target := range p.targets {
+		p.data.refs.zero(target)
+		p.data.refs.remove(target)
+		p.data.raceRemoveTarget(target)
+		if p.data.swapped[target] == p {
+			delete(p.data.swapped, target)
+		}
+	}
+	p.targets = nil
+	p.stored = 0
+	if p.released {
+		return false
+	}
+	p.released = true
+	if p.done != nil {
+		close(p.done)
+	}
+	// Skipped foreign pointers have no object, so there is nothing to release.
+	if p.obj == nil {
+		return false
+	}
+	if ptrs := removePointer(p.data.ptrs, p.obj); len(ptrs) < len(p.data.ptrs) {
+		p.data.ptrs = ptrs
+		p.data.pins = removePinnedValue(p.data.pins, p)
+		p.data.pinned--
+		p.data.uncountPins(1)
+		p.data.release(p.obj)
+		return true
+	}
+	return false
+}
+
+// WaitReleased blocks until all pinned objects of the given Pinned values have
+// been released, i.e. either the Pinned values themselves have been unpinned
+// with `Pinned.Unpin()`, or their Pinners have been unpinned and, in case of
+// UnpinAsync(), the release is complete. This can be used to make sure that a
+// buffer is not pinned anymore, before reusing it. Pinned values, that don't
+// pin anything, like the ones of empty inputs, don't block.
+func WaitReleased(pinned ...*Pinned) {
+	for _, p := range pinned {
+		p.waitReleased()
+	}
+}
+
+func (p *Pinned) waitReleased() {
+	for {
+		data := p.lock()
+		if data == nil {
+			return
+		}
+		if data.released {
+			data.mtx.Unlock()
+			<-data.drained
+			return
+		}
+		if p.released || p.obj == nil {
+			data.mtx.Unlock()
+			return
+		}
+		if p.done == nil {
+			p.done = make(chan struct{})
+		}
+		done := p.done
+		data.mtx.Unlock()
+		// The drained channel is also closed, when the Pinned value has been
+		// moved to another Pinner by Merge(), so the state is checked again.
+		select {
+		case <-done:
+		case <-data.drained:
+		}
+	}
+}
+
+// lock returns the data of the Pinned value with its mutex locked, or nil if it
+// has none. Since Merge() moves the Pinned value to the data of another Pinner
+// while holding the mutex of the previous data, the data is loaded again after
+// locking, until it is stable.
+func (p *Pinned) lock() *data {
+	for {
+		d := p.loadData()
+		if d == nil {
+			return nil
+		}
+		d.mtx.Lock()
+		if d == p.loadData() {
+			return d
+		}
+		d.mtx.Unlock()
+	}
+}
+
+// loadData returns the data of the Pinned value without locking it, e.g. to
+// check whether it has any. It is only stable with the mutex of the data held,
+// see lock().
+func (p *Pinned) loadData() *data {
+	return (*data)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&p.data))))
+}
+
+// String returns a description of the pinned pointer for debugging, containing
+// its address and how often it has been stored.
+func (p *Pinned) String() string {
+	if p == nil {
+		return "Pinned{nil}"
+	}
+	data := p.lock()
+	if data == nil {
+		return "Pinned{nil}"
+	}
+	defer data.mtx.Unlock()
+	return fmt.Sprintf("Pinned{%p, stored:%d}", p.ptr, p.stored)
+}
+
+// DisableLeakCheck disables the detection of a leaked Pinner, i.e. one that is
+// collected by the garbage collector without `Unpin()`, for performance-critical
+// code, where `Unpin()` is guaranteed to be called. If it is called on a new
+// Pinner, before anything is pinned, the finalizer needed for the detection is
+// not even set, which saves its costs for the garbage collector. The objects of
+// a leaked Pinner without leak check stay pinned forever without any notice,
+// and so does the memory of its background go routines. Only with
+// BackendRuntime the runtime.Pinner still panics by itself, when it is leaked.
+// The leak check can't be enabled again.
+func (p *Pinner) DisableLeakCheck() {
+	if !p.newInstance(false) {
+		runtime.SetFinalizer(p.instance, nil)
+	}
+}
+
+// SetMaxStoredRefs limits the number of targets pinned pointers of the Pinner
+// can be stored at with the `Store()` method, until `Unpin()` is called. If the
+// limit is exceeded, the handler set with SetRefsLimitHandler() is called, which
+// panics by default. This helps catching bugs like storing pinned pointers in an
+// unbounded loop by mistake. A limit of zero or less means unlimited, which is
+// the default.
+func (p *Pinner) SetMaxStoredRefs(n int) {
+	p.init()
+	p.instance.mtx.Lock()
+	p.maxRefs = n
+	p.instance.mtx.Unlock()
+	if data := p.lockData(false); data != nil {
+		data.refs.max = n
+		data.mtx.Unlock()
+	}
+}
+
+// SetZeroOnUnpin sets whether `Unpin()` zeroes the targets, that pinned pointers
+// of the Pinner have been stored at, which is enabled by default. Disabling it
+// saves the work for many targets, when the C memory is freed right after
+// `Unpin()` anyway, e.g. with Absorb().
+//
+// WARNING: With zeroing disabled, the targets still contain the pointers after
+// `Unpin()`, when the objects may be moved or collected already. The C memory
+// must not be read anymore by C or Go, and it must not be passed to the garbage
+// collector, e.g. as part of Go memory, otherwise this leads to memory
+// corruption or crashes. `Unpin()` of individual Pinned values and Clear()
+// always zero their targets.
+func (p *Pinner) SetZeroOnUnpin(enabled bool) {
+	p.init()
+	p.instance.mtx.Lock()
+	p.noZero = !enabled
+	p.instance.mtx.Unlock()
+}
+
+// Merge transfers all pinned objects, stored pointers and functions registered
+// with Absorb() of the other Pinner to the Pinner, so that they are all
+// released by a single `Unpin()` of the Pinner. The other Pinner is left empty,
+// as if it had been unpinned, but without zeroing the stored pointers. The
+// Pinned values returned by its Pin() and similar methods belong to the Pinner
+// afterwards. Merging an uninitialized or unpinned Pinner has no effect.
+func (p *Pinner) Merge(other *Pinner) {
+	if other == p || other.instance == nil {
+		return
+	}
+	other.instance.mtx.Lock()
+	src := other.data
+	if src == nil {
+		other.instance.mtx.Unlock()
+		return
+	}
+	other.data = nil
+	other.draining = src.drained
+	other.instance.mtx.Unlock()
+	dst := p.lockData(true)
+	src.mtx.Lock()
+	// Pin the objects with the keeper of the Pinner, before they are released
+	// by the keeper of the other one.
+	for _, ptr := range src.ptrs {
+		dst.keep(ptr)
+	}
+	dst.pinned += src.pinned
+	dst.counted += src.counted
+	src.counted = 0
+	dst.bytes += src.bytes
+	dst.ptrs = append(dst.ptrs, src.ptrs...)
+	for _, pinned := range src.pins {
+		atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&pinned.data)),
+			unsafe.Pointer(dst))
+	}
+	dst.pins = append(dst.pins, src.pins...)
+	src.raceMoveTargets(dst)
+	dst.refs.cPtr = append(dst.refs.cPtr, src.refs.cPtr...)
+	for target := range src.refs.atomic {
+		if dst.refs.atomic == nil {
+			dst.refs.atomic = make(map[*unsafe.Pointer]struct{})
+		}
+		dst.refs.atomic[target] = struct{}{}
+	}
+	dst.frees = append(dst.frees, src.frees...)
+	for ptr := range src.absorbed {
+		if dst.absorbed == nil {
+			dst.absorbed = make(map[unsafe.Pointer]struct{})
+		}
+		dst.absorbed[ptr] = struct{}{}
+	}
+	for slot, pinned := range src.swapped {
+		if dst.swapped == nil {
+			dst.swapped = make(map[*unsafe.Pointer]*Pinned)
+		}
+		dst.swapped[slot] = pinned
+	}
+	src.refs.cPtr = nil
+	src.frees = nil
+	src.released = true
+	src.mtx.Unlock()
+	dst.mtx.Unlock()
+	unregisterActive(src)
+	src.drain()
+}
+
+// Absorb hands the ownership of the C allocations ptrs over to the Pinner. The
+// freeFn function must free them and is called exactly once by `Unpin()`, after
+// all pinned objects have been released and all stored pointers have been
+// zeroed. This way a single `Unpin()` call can tear down C memory, like an
+// iovec array, and the pinned objects it refers to in the correct order. Like
+// with Pin(), `Unpin()` must be called afterwards on the same Pinner. The ptrs
+// are recorded until then, and if one of them has already been absorbed by the
+// Pinner, Absorb() panics without registering freeFn, because it would be freed
+// twice. Nil pointers are not recorded.
+func (p *Pinner) Absorb(freeFn func(), ptrs ...unsafe.Pointer) {
+	data := p.lockData(true)
+	defer data.mtx.Unlock()
+	for i, ptr := range ptrs {
+		if ptr == nil {
+			continue
+		}
+		_, absorbed := data.absorbed[ptr]
+		for _, prev := range ptrs[:i] {
+			absorbed = absorbed || prev == ptr
+		}
+		if absorbed {
+			panic(fmt.Sprintf("ptrguard: C pointer %p has already been absorbed", ptr))
+		}
+	}
+	for _, ptr := range ptrs {
+		if ptr == nil {
+			continue
+		}
+		if data.absorbed == nil {
+			data.absorbed = make(map[unsafe.Pointer]struct{})
+		}
+		data.absorbed[ptr] = struct{}{}
+	}
+	data.frees = append(data.frees, freeFn)
+}
+
+// RangeTargets calls f for each target a pinned pointer of the Pinner has been
+// stored at with the `Store()` method, in the order of the stores. It passes
+// the address of the target and its current content. If f returns false, the
+// iteration stops. This is a read-only diagnostic, that can be used to verify
+// that the stored pointers have not been overwritten unexpectedly, e.g. by C
+// code.
+func (p *Pinner) RangeTargets(f func(slot unsafe.Pointer, value unsafe.Pointer) bool) {
+	data := p.lockData(false)
+	if data == nil {
+		return
+	}
+	// f is called without the lock, so that it may use the Pinner.
+	targets := make([]*unsafe.Pointer, len(data.refs.cPtr))
+	copy(targets, data.refs.cPtr)
+	data.mtx.Unlock()
+	for _, target := range targets {
+		if !f(unsafe.Pointer(target), *target) {
+			return
+		}
+	}
+}
+
+// CopyTargets copies the current content of each target a pinned pointer of the
+// Pinner has been stored at with the `Store()` method into the C memory at dst,
+// in the order of the stores, with stride bytes between the copies. The copies
+// are not registered with the Pinner, so they are not zeroed by `Unpin()`. This
+// allows to hand a snapshot of the stored pointers to a C consumer, while the
+// original targets may change. There must be room for as many pointers as have
+// been stored.
+func (p *Pinner) CopyTargets(dst unsafe.Pointer, stride uintptr) {
+	data := p.lockData(false)
+	if data == nil {
+		return
+	}
+	defer data.mtx.Unlock()
+	for i, target := range data.refs.cPtr {
+		slot := (*unsafe.Pointer)(unsafe.Pointer(uintptr(dst) + uintptr(i)*stride))
+		*hiddenPtr(slot) = *hiddenPtr(target)
+	}
+}
+
+// ForEachPinned calls f for each object that is currently pinned by the Pinner,
+// in the order of the pins, with the pinned pointer. The backing array of
+// PinSliceElements() is passed once for each of its pinned elements. Pointers
+// that have been skipped by the foreign pointer check or released by `Swap()`
+// are not included, and neither are the no-op pins of empty inputs. It can serve as a
+// building block for bulk operations on the pinned objects, like validating or
+// re-storing them.
+func (p *Pinner) ForEachPinned(f func(ptr unsafe.Pointer)) {
+	data := p.lockData(false)
+	if data == nil {
+		return
+	}
+	// f is called without the lock, so that it may use the Pinner.
+	ptrs := make([]unsafe.Pointer, len(data.ptrs))
+	copy(ptrs, data.ptrs)
+	data.mtx.Unlock()
+	for _, ptr := range ptrs {
+		f(ptr)
+	}
+}
+
+// Pins returns the Pinned values of the objects, that are currently pinned by the
+// Pinner, in the order of the pins, e.g. for debugging or to unpin or store
+// them in bulk. It is a snapshot, that is not updated by later pins or unpins.
+// Like with ForEachPinned(), pointers that have been skipped by the foreign
+// pointer check or released by `Swap()` are not included, and neither are the
+// no-op pins of empty inputs.
+func (p *Pinner) Pins() []*Pinned {
+	data := p.lockData(false)
+	if data == nil {
+		return nil
+	}
+	defer data.mtx.Unlock()
+	pins := make([]*Pinned, len(data.pins))
+	copy(pins, data.pins)
+	return pins
+}
+
+// Pointer returns the pinned pointer. It is valid, i.e. it can be stored in C
+// memory or in Go memory passed to C, until `Unpin()` is called on the Pinner.
+// For the no-op Pinned values of empty inputs it returns nil.
+func (p *Pinned) Pointer() unsafe.Pointer {
+	return p.ptr
+}
+
+// Uintptr returns the pinned pointer as uintptr, e.g. for C APIs, that take
+// pointers as intptr_t handles. It is only valid as long as the object is
+// pinned, i.e. until `Unpin()` is called on the Pinner. Since the garbage
+// collector doesn't recognize a uintptr as a pointer, it must be converted back
+// only while the object is still pinned. For the no-op Pinned values of empty
+// inputs it returns 0.
+func (p *Pinned) Uintptr() uintptr {
+	return uintptr(p.ptr)
+}
+
+// BindTo pins the object of the pinned pointer also with the other Pinner and
+// returns the new Pinned value. The object stays pinned until both Pinners have
+// been unpinned, so the two pins have independent lifetimes.
+func (p *Pinned) BindTo(other *Pinner) *Pinned {
+	if p.loadData() == nil {
+		return &Pinned{}
+	}
+	return other.Pin(p.ptr)
+}
+
+// Len returns the number of objects, that are currently pinned by the Pinner.
+// It is 0 for an uninitialized Pinner and after `Unpin()`.
+func (p *Pinner) Len() int {
+	data := p.lockData(false)
+	if data == nil {
+		return 0
+	}
+	defer data.mtx.Unlock()
+	return data.pinned
+}
+
+// StoredCount returns the number of targets, a pinned pointer of the Pinner has
+// been stored at with the `Store()` method, i.e. that will be zeroed by
+// `Unpin()`. It is 0 for an uninitialized Pinner and after `Unpin()`.
+func (p *Pinner) StoredCount() int {
+	data := p.lockData(false)
+	if data == nil {
+		return 0
+	}
+	defer data.mtx.Unlock()
+	return len(data.refs.cPtr)
+}
+
+// String returns a description of the state of the Pinner for debugging,
+// containing the number of pinned objects and stored pointers.
+func (p *Pinner) String() string {
+	return fmt.Sprintf("Pinner{pinned:%d, stored:%d}", p.Len(), p.StoredCount())
 }
 
 // NoCheck temporarily disables cgocheck, which allows passing Go memory
@@ -86,115 +1329,574 @@ func (p *Pinned) Store(target interface{}) {
 // happen that cgocheck is also disabled for some other C calls. If this is an
 // issue, it is also possible to shadow the cgocheck call instead with this code
 // line
-//   _cgoCheckPointer := func(interface{}, interface{}) {}
-// right before the C function call.
+//
+//	_cgoCheckPointer := func(interface{}, interface{}) {}
+//
+// right before the C function call. cgocheck is restored, even if f panics. If
+// the package is built without cgo, NoCheck() simply calls f. The same applies
+// to the build tag ptrguard_nolinkname, which avoids the access of the runtime
+// variable with go:linkname for toolchains, that forbid it. Then shadowing is
+// the only way to pass such Go memory to C.
 func NoCheck(f func()) {
 	cgocheckOff()
+	defer cgocheckOn()
+	f()
+}
+
+// NoCheckErr is like NoCheck(), but it returns the error returned by f, e.g.
+// of the C call made by f. cgocheck is restored, even if f panics.
+func NoCheckErr(f func() error) error {
+	cgocheckOff()
+	defer cgocheckOn()
+	return f()
+}
+
+// NoCheckContext is like NoCheck(), but cgocheck is also restored when ctx is
+// done before f returns. It can't abort f or a C call made by f, so f should
+// honor ctx by itself, but it ensures that cgocheck is not disabled longer than
+// the lifetime of ctx for C calls made elsewhere in parallel.
+func NoCheckContext(ctx context.Context, f func()) {
+	var once sync.Once
+	restore := func() { once.Do(cgocheckOn) }
+	cgocheckOff()
+	defer restore()
+	returned := make(chan struct{})
+	defer close(returned)
+	go func() {
+		select {
+		case <-ctx.Done():
+			restore()
+		case <-returned:
+		}
+	}()
 	f()
-	cgocheckOn()
 }
 
 type instance struct {
+	mtx sync.Mutex // guards data and the fields below
 	*data
+	maxRefs int
+	// stored pointers are not zeroed by Unpin(), see SetZeroOnUnpin()
+	noZero bool
+	// number of stored pointers given to NewPinner()
+	capHint int
+	// recent peak of the number of stored pointers, decaying by half on each
+	// PutPinner(), used to pre-grow the refs when the Pinner is reused.
+	peakRefs int
+	// drained channel of the last unpinned data
+	draining chan struct{}
+}
+
+func (p *Pinner) init() {
+	p.newInstance(true)
+}
+
+// newInstance creates the instance of the Pinner, if it has none yet, and
+// reports whether it has been created. If leakCheck is true, a finalizer is set
+// on the instance, that detects when the Pinner is leaked.
+func (p *Pinner) newInstance(leakCheck bool) bool {
+	// The instance is created atomically, so that a zero Pinner can be shared
+	// by go routines, that pin concurrently.
+	ptr := (*unsafe.Pointer)(unsafe.Pointer(&p.instance))
+	if atomic.LoadPointer(ptr) != nil {
+		return false
+	}
+	inst := &instance{}
+	if !atomic.CompareAndSwapPointer(ptr, nil, unsafe.Pointer(inst)) {
+		return false
+	}
+	if !leakCheck {
+		return true
+	}
+	runtime.SetFinalizer(inst, func(i *instance) {
+		if i.data != nil {
+			// The objects of a leaked Pinner stay pinned forever, because they
+			// might still be used by C. Without this, a runtime.Pinner of the
+			// runtime backend would also be collected and panic by itself.
+			leaked = append(leaked, i.data.keeper)
+			i.data.raceDropTargets()
+			// It is reported here already, so it is not reported by Leaks().
+			unregisterActive(i.data)
+			LeakHandler()(&LeakError{
+				Pins:   i.data.pinned,
+				Stacks: formatStacks(i.data.stacks()),
+			})
+		}
+	})
+	return true
+}
+
+// leaked contains the keepers of all leaked Pinners. It is only accessed by the
+// finalizer go routine.
+var leaked []keeper
+
+// lockData returns the data of the Pinner with its mutex locked. If the
+// Pinner has no data, it is created if create is true, otherwise nil is
+// returned.
+func (p *Pinner) lockData(create bool) *data {
+	if create {
+		p.init()
+	} else if atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&p.instance))) == nil {
+		return nil
+	}
+	p.instance.mtx.Lock()
+	defer p.instance.mtx.Unlock()
+	if p.data == nil {
+		if !create {
+			return nil
+		}
+		data := &data{
+			keeper:  newKeeper[CurrentBackend()](),
+			drained: make(chan struct{}),
+		}
+		data.refs.max = p.maxRefs
+		n := p.peakRefs
+		if p.capHint > n {
+			n = p.capHint
+		}
+		if n > 0 {
+			data.refs.cPtr = make([]*unsafe.Pointer, 0, n)
+		}
+		p.data = data
+		registerActive(data)
+	}
+	p.data.mtx.Lock()
+	return p.data
 }
 
 type data struct {
-	release sync.RWMutex
-	wg      sync.WaitGroup
+	mtx       sync.Mutex                  // guards the fields below
+	keeper    keeper                      // keeps the pinned objects alive
+	drained   chan struct{}               // closed when unpinning is complete
+	pinned    int                         // number of Pin() calls
+	counted   int                         // number of pins counted for expvar
+	bytes     int                         // total length of buffers pinned with PinBytes()
+	ptrs      []unsafe.Pointer            // currently pinned pointers
+	pins      []*Pinned                   // Pinned values of the current pins
+	swapped   map[*unsafe.Pointer]*Pinned // last Pinned values of Swap()
+	counts    map[unsafe.Pointer]int      // number of pins of each pointer
+	autoUnpin *time.Timer                 // timer of SetAutoUnpin()
+	absorbed  map[unsafe.Pointer]struct{} // C pointers passed to Absorb()
 	refs
+	frees    []func()
+	released bool
+}
+
+// keep hands ptr over to the keeper, unless it is already pinned, in which case
+// only its reference count is incremented. This way repeated pins of the same
+// object don't add up, e.g. to parked go routines.
+func (d *data) keep(ptr unsafe.Pointer) {
+	if d.counts == nil {
+		d.counts = make(map[unsafe.Pointer]int)
+	}
+	if d.counts[ptr] == 0 {
+		d.keeper.pin(ptr)
+	}
+	d.counts[ptr]++
 }
 
-func unpin(p *instance) {
-	if p == nil || p.data == nil {
+// keepAll is like keep() for all ptrs, but the pointers, that are not pinned
+// yet, are handed over to the keeper at once, if it supports it.
+func (d *data) keepAll(ptrs []unsafe.Pointer) {
+	bk, ok := d.keeper.(batchKeeper)
+	if !ok {
+		for _, ptr := range ptrs {
+			d.keep(ptr)
+		}
+		return
+	}
+	if d.counts == nil {
+		d.counts = make(map[unsafe.Pointer]int)
+	}
+	batch := make([]unsafe.Pointer, 0, len(ptrs))
+	for _, ptr := range ptrs {
+		if d.counts[ptr] == 0 {
+			batch = append(batch, ptr)
+		}
+		d.counts[ptr]++
+	}
+	if len(batch) > 0 {
+		bk.pinBatch(batch)
+	}
+}
+
+// release decrements the reference count of ptr and releases it from the
+// keeper, when it reaches zero.
+func (d *data) release(ptr unsafe.Pointer) {
+	switch d.counts[ptr] {
+	case 0:
+		return
+	case 1:
+		delete(d.counts, ptr)
+		d.keeper.release(ptr)
+	default:
+		d.counts[ptr]--
+	}
+}
+
+func unpin(p *instance, async bool) {
+	unpinData(p, nil, async)
+}
+
+// unpinData unpins the data of the instance, but only if it is expected, unless
+// expected is nil.
+func unpinData(p *instance, expected *data, async bool) {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	data := p.data
+	if data == nil || expected != nil && data != expected {
+		p.mtx.Unlock()
 		return
 	}
-	p.refs.clear()
-	p.release.Unlock() // broadcast "release" to all go routines
-	p.wg.Wait()        // wait for all pinned pointers to be released
+	data.mtx.Lock()
+	if data.autoUnpin != nil {
+		data.autoUnpin.Stop()
+	}
+	data.raceReleaseTargets()
+	// The targets must be zeroed before the objects are released by drain(),
+	// so that C never reads a pointer to a released object.
+	if p.noZero {
+		data.refs.cPtr = nil
+		data.refs.atomic = nil
+	} else {
+		data.refs.clear()
+	}
+	data.released = true
+	data.uncountPins(data.counted)
+	data.mtx.Unlock()
+	unregisterActive(data)
+	p.draining = data.drained
 	p.data = nil
+	p.mtx.Unlock()
+	if onUnpin != nil {
+		onUnpin(data.pinned)
+	}
+	if async {
+		go data.drain()
+	} else {
+		data.drain()
+	}
+}
+
+func (d *data) drain() {
+	d.keeper.releaseAll() // wait for all pinned pointers to be released
+	for _, free := range d.frees {
+		free()
+	}
+	close(d.drained)
 }
 
 type refs struct {
-	cPtr []*unsafe.Pointer
+	cPtr   []*unsafe.Pointer
+	atomic map[*unsafe.Pointer]struct{} // targets that are zeroed atomically
+	max    int
 }
 
-func (r *refs) add(target *unsafe.Pointer) {
+// checkLimit calls the handler of SetRefsLimitHandler(), if another target
+// would exceed the limit of stored pointers.
+func (r *refs) checkLimit() {
+	if r.max > 0 && len(r.cPtr) >= r.max {
+		RefsLimitHandler()(&RefsLimitError{Limit: r.max})
+	}
+}
+
+func (r *refs) add(target *unsafe.Pointer, atomically bool) {
 	r.cPtr = append(r.cPtr, target)
+	if atomically {
+		if r.atomic == nil {
+			r.atomic = make(map[*unsafe.Pointer]struct{})
+		}
+		r.atomic[target] = struct{}{}
+	}
 }
 
-func (r *refs) clear() {
-	for i := range r.cPtr {
-		*r.cPtr[i] = nil
-		r.cPtr[i] = nil
+func (r *refs) isAtomic(target *unsafe.Pointer) bool {
+	_, ok := r.atomic[target]
+	return ok
+}
+
+// zero sets a single target to nil.
+func (r *refs) zero(target *unsafe.Pointer) {
+	if r.isAtomic(target) {
+		atomic.StoreUintptr((*uintptr)(unsafe.Pointer(target)), 0)
+	} else {
+		*target = nil
 	}
-	r.cPtr = nil
 }
 
-var (
-	cgocheckMtx sync.Mutex
-	cgocheckCnt uint
-	cgocheckOld int32
-)
+// remove removes the first occurrence of target, keeping the order of the
+// remaining targets.
+func (r *refs) remove(target *unsafe.Pointer) {
+	for i := range r.cPtr {
+		if r.cPtr[i] == target {
+			last := len(r.cPtr) - 1
+			copy(r.cPtr[i:], r.cPtr[i+1:])
+			r.cPtr[last] = nil
+			r.cPtr = r.cPtr[:last]
+			return
+		}
+	}
+}
 
-func cgocheckOff() {
-	cgocheckMtx.Lock()
-	if cgocheckCnt == 0 {
-		cgocheckOld = *cgocheck
-		*cgocheck = 0
+// clear zeroes all targets. Runs of adjacent targets, that have been stored in
+// ascending order, like the entries of an array, are cleared at once through a
+// slice of unsafe.Pointer, which is much faster than zeroing them one by one,
+// and keeps the write barriers intact, if the targets are in Go memory.
+// Atomic targets are always zeroed one by one.
+func (r *refs) clear() {
+	targets := r.cPtr
+	for len(targets) > 0 {
+		n := r.runLen(targets)
+		if n == 1 {
+			r.zero(targets[0])
+		} else {
+			// The slice is built with a header instead of converting to a
+			// pointer to a large array, since the adjacent targets may be
+			// in different allocations, which checkptr rejects.
+			var run []unsafe.Pointer
+			h := (*reflect.SliceHeader)(unsafe.Pointer(&run))
+			h.Data, h.Len, h.Cap = uintptr(unsafe.Pointer(targets[0])), n, n
+			for i := range run {
+				run[i] = nil
+			}
+		}
+		targets = targets[n:]
 	}
-	cgocheckCnt++
-	cgocheckMtx.Unlock()
+	r.cPtr = nil
+	r.atomic = nil
 }
 
-func cgocheckOn() {
-	cgocheckMtx.Lock()
-	cgocheckCnt--
-	if cgocheckCnt == 0 {
-		*cgocheck = cgocheckOld
+// runLen returns the number of adjacent non-atomic targets in ascending order
+// at the start of targets, or 1 if the first one is atomic.
+func (r *refs) runLen(targets []*unsafe.Pointer) int {
+	// Most Pinners have no atomic targets, so the lookups can be skipped.
+	checkAtomic := len(r.atomic) > 0
+	if checkAtomic && r.isAtomic(targets[0]) {
+		return 1
 	}
-	cgocheckMtx.Unlock()
+	const size = unsafe.Sizeof(unsafe.Pointer(nil))
+	next := uintptr(unsafe.Pointer(targets[0])) + size
+	n := 1
+	for n < len(targets) && uintptr(unsafe.Pointer(targets[n])) == next &&
+		!(checkAtomic && r.isAtomic(targets[n])) {
+		next += size
+		n++
+	}
+	return n
 }
 
-func getPtr(i interface{}) unsafe.Pointer {
-	val := reflect.ValueOf(i)
+func getPtr(i interface{}) (unsafe.Pointer, error) {
+	return getValuePtr(reflect.ValueOf(i))
+}
+
+func getValuePtr(val reflect.Value) (unsafe.Pointer, error) {
 	if k := val.Kind(); k == reflect.Ptr || k == reflect.UnsafePointer {
-		return unsafe.Pointer(val.Pointer())
+		return unsafe.Pointer(val.Pointer()), nil
 	}
-	panic(fmt.Sprintf("%s is not a pointer", val.Type()))
+	var typ reflect.Type
+	if val.IsValid() {
+		typ = val.Type()
+	}
+	return nil, &NotPointerError{Type: typ}
 }
 
-func getPtrPtr(i interface{}) *unsafe.Pointer {
+func getPtrPtr(i interface{}) (*unsafe.Pointer, error) {
 	val := reflect.ValueOf(i)
 	if k := val.Kind(); k == reflect.Ptr {
 		if k = val.Elem().Kind(); k == reflect.Ptr || k == reflect.UnsafePointer {
-			return (*unsafe.Pointer)(unsafe.Pointer(val.Pointer()))
+			return (*unsafe.Pointer)(unsafe.Pointer(val.Pointer())), nil
 		}
 	}
-	panic(fmt.Sprintf("%s is not a pointer to a pointer", val.Type()))
+	return nil, &NotPointerToPointerError{Type: reflect.TypeOf(i)}
 }
 
+// hiddenPtr returns the memory of the pointer at p as byte array, so that
+// pointers can be copied without being checked by cgocheck. The array has the
+// size of a pointer on the target platform, and the bytes are copied in their
+// native order, so the copy is correct for any pointer width and endianness.
 func hiddenPtr(p *unsafe.Pointer) *[unsafe.Sizeof(unsafe.Pointer(nil))]byte {
 	return (*[unsafe.Sizeof(unsafe.Pointer(nil))]byte)(unsafe.Pointer(p))
 }
 
-// From https://golang.org/src/cmd/compile/internal/gc/lex.go:
-// For the next function declared in the file any uintptr arguments may be
-// pointer values converted to uintptr. This directive ensures that the
-// referenced allocated object, if any, is retained and not moved until the call
-// completes, even though from the types alone it would appear that the object
-// is no longer needed during the call. The conversion to uintptr must appear in
-// the argument list.
-// Also see https://golang.org/cmd/compile/#hdr-Compiler_Directives
+// The pinning go routines are labeled with "ptrguard-pin", so that they can be
+// identified in goroutine profiles, e.g. when looking for leaked pins.
+var pinLabels = pprof.Labels("ptrguard-pin", "true")
 
-//go:uintptrescapes
-func pinUntilRelease(pinned *sync.Mutex, release *sync.RWMutex, _ uintptr) {
-	pinned.Unlock() // send "pinned" signal to main thread.
-	release.RLock() // wait for "release" broadcast from main thread when
-	//                 unpin() has been called.
+// pinAddrs returns the addresses of ptrs separated by spaces for the
+// ptrguard-addr label of the pinning go routines, but only in debug mode.
+// Otherwise it returns an empty string, and the go routines are only labeled
+// with pinLabels.
+func pinAddrs(ptrs ...unsafe.Pointer) string {
+	if !debug {
+		return ""
+	}
+	return fmtAddrs(ptrs)
+}
+
+func fmtAddrs(ptrs []unsafe.Pointer) string {
+	var b strings.Builder
+	for i, ptr := range ptrs {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%p", ptr)
+	}
+	return b.String()
+}
+
+// pinAddrLabels returns the labels of a pinning go routine, that keeps the
+// objects at addrs alive, as returned by pinAddrs().
+func pinAddrLabels(addrs string) pprof.LabelSet {
+	if addrs == "" {
+		return pinLabels
+	}
+	return pprof.Labels("ptrguard-pin", "true", "ptrguard-addr", addrs)
+}
+
+// setPinLabels labels the calling go routine with pinAddrLabels(addrs).
+func setPinLabels(addrs string) {
+	labels := pinAddrLabels(addrs)
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), labels))
+}
+
+// goPinUntilRelease starts pinUntilRelease() in a new labeled go routine. If
+// labelAddrs is true, the go routine labels itself with the addresses of the
+// objects, it currently keeps alive.
+func goPinUntilRelease(pins <-chan pinOp, done chan<- struct{}, labelAddrs bool) {
+	go pprof.Do(context.Background(), pinLabels, func(context.Context) {
+		pinUntilRelease(pins, done, labelAddrs)
+	})
+}
+
+// pinOp is a request to the pinning go routine to pin ptr, or to release it
+// again.
+type pinOp struct {
+	ptr     unsafe.Pointer
+	release bool
+}
+
+// pinUntilRelease keeps all pointers received from pins reachable until they
+// are released, or until pins is closed by unpin(). Then it closes done and
+// exits.
+func pinUntilRelease(pins <-chan pinOp, done chan<- struct{}, labelAddrs bool) {
+	var pinned []unsafe.Pointer
+	for op := range pins {
+		if !op.release {
+			pinned = append(pinned, op.ptr)
+		} else {
+			pinned = removePointer(pinned, op.ptr)
+		}
+		if labelAddrs {
+			setPinLabels(fmtAddrs(pinned))
+		}
+	}
+	runtime.KeepAlive(pinned)
+	close(done)
+}
+
+// removePointer removes the first occurrence of ptr from s, keeping the order
+// of the remaining elements.
+func removePointer(s []unsafe.Pointer, ptr unsafe.Pointer) []unsafe.Pointer {
+	for i := range s {
+		if s[i] == ptr {
+			last := len(s) - 1
+			copy(s[i:], s[i+1:])
+			s[last] = nil
+			return s[:last]
+		}
+	}
+	return s
+}
+
+// removePinnedValue removes p from s, keeping the order of the remaining
+// elements.
+func removePinnedValue(s []*Pinned, p *Pinned) []*Pinned {
+	for i := range s {
+		if s[i] == p {
+			return removePinnedAt(s, i)
+		}
+	}
+	return s
+}
+
+func removePinnedAt(s []*Pinned, i int) []*Pinned {
+	last := len(s) - 1
+	copy(s[i:], s[i+1:])
+	s[last] = nil
+	return s[:last]
+}
+
+var (
+	leakHandlerMtx sync.Mutex
+	leakHandler    = leakPanic
+)
+
+// SetLeakHandler sets the function, that is called when the garbage collector
+// finds a Pinner with pinned objects, that has not been unpinned, with a
+// *LeakError describing the leak. The objects of such a Pinner stay pinned
+// forever, since they might still be used by C. By default the handler panics
+// with the *LeakError, which crashes the program. A
+// handler, that only logs the leak instead, allows to continue at the cost of
+// the leaked memory. Passing nil restores the default. SetLeakHandler() can be
+// called at any time, but the handler is called on the finalizer go routine of
+// the runtime, so it must be safe to run concurrently with the rest of the
+// program, and it should return quickly, because it blocks all other
+// finalizers.
+func SetLeakHandler(fn func(err *LeakError)) {
+	if fn == nil {
+		fn = leakPanic
+	}
+	leakHandlerMtx.Lock()
+	leakHandler = fn
+	leakHandlerMtx.Unlock()
+}
+
+// LeakHandler returns the function, that is called when a leaked Pinner is
+// found, as set by SetLeakHandler().
+func LeakHandler() func(err *LeakError) {
+	leakHandlerMtx.Lock()
+	defer leakHandlerMtx.Unlock()
+	return leakHandler
+}
+
+// leakPanic is the default leak handler.
+func leakPanic(err *LeakError) {
+	panic(err)
+}
+
+var (
+	refsLimitHandlerMtx sync.Mutex
+	refsLimitHandler    = refsLimitPanic
+)
+
+// SetRefsLimitHandler sets the function, that is called with a *RefsLimitError,
+// when a pinned pointer is stored, although the number of stored pointers of
+// its Pinner has already reached the limit set with SetMaxStoredRefs(). By
+// default the handler panics with the *RefsLimitError. If the handler returns,
+// the pointer is stored anyway, so a handler, that only logs the spill, keeps
+// the program running. Passing nil restores the default. The handler is called
+// while the Pinner is locked, so it must not call any methods of the Pinner or
+// of its Pinned values.
+func SetRefsLimitHandler(fn func(err *RefsLimitError)) {
+	if fn == nil {
+		fn = refsLimitPanic
+	}
+	refsLimitHandlerMtx.Lock()
+	refsLimitHandler = fn
+	refsLimitHandlerMtx.Unlock()
+}
+
+// RefsLimitHandler returns the function, that is called when the limit of
+// stored pointers is exceeded, as set by SetRefsLimitHandler().
+func RefsLimitHandler() func(err *RefsLimitError) {
+	refsLimitHandlerMtx.Lock()
+	defer refsLimitHandlerMtx.Unlock()
+	return refsLimitHandler
 }
 
-// To be able to test that the GC panics when a pinned pointer is leaking, this
-// panic function is a variable, that can be overwritten by a test.
-var leakPanic = func() {
-	panic("ptrguard: Found leaking pinned pointer. Forgot to call Unpin()?")
+// refsLimitPanic is the default refs limit handler.
+func refsLimitPanic(err *RefsLimitError) {
+	panic(err)
 }
@@ -0,0 +1,27 @@
+package ptrguard // nolint:testpackage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDraining(t *testing.T) {
+	var pg Pinner
+	pg.Pin(&[1]byte{})
+	// Block the free function, to hold the Pinner in the draining state.
+	hold := make(chan struct{})
+	freeing := make(chan struct{})
+	pg.Absorb(func() {
+		close(freeing)
+		<-hold
+	})
+	pg.UnpinAsync()
+	assert.True(t, pg.Draining())
+	<-freeing
+	assert.True(t, pg.Draining())
+	close(hold)
+	assert.Eventually(t, func() bool { return !pg.Draining() },
+		5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,42 @@
+package ptrguard // nolint:testpackage
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// These tests don't need cgo, so that they can be run for other platforms, e.g.
+// with GOARCH=386 CGO_ENABLED=0.
+
+func TestHiddenPtr(t *testing.T) {
+	assert.Equal(t, unsafe.Sizeof(uintptr(0)), unsafe.Sizeof(*hiddenPtr(nil)))
+	// A pattern of distinct bytes detects truncated or reordered copies.
+	var pattern uintptr
+	for i := uintptr(1); i <= unsafe.Sizeof(pattern); i++ {
+		pattern = pattern<<8 | i
+	}
+	src := pattern
+	var dst uintptr
+	*hiddenPtr((*unsafe.Pointer)(unsafe.Pointer(&dst))) =
+		*hiddenPtr((*unsafe.Pointer)(unsafe.Pointer(&src)))
+	assert.Equal(t, pattern, dst)
+}
+
+func TestStoreNativeLayout(t *testing.T) {
+	s := "fooBar"
+	// The slots are uintptr, so that they are not scanned by the garbage
+	// collector, like C memory.
+	var slots [4]uintptr
+	var pg Pinner
+	pp := pg.Pin(&s)
+	for i := range slots {
+		pp.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&slots[i])))
+	}
+	for i := range slots {
+		assert.Equal(t, uintptr(unsafe.Pointer(&s)), slots[i])
+	}
+	pg.Unpin()
+	assert.Equal(t, [4]uintptr{}, slots)
+}
@@ -1,7 +1,9 @@
 package ptrguard // nolint:testpackage
 
 import (
+	"fmt"
 	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -9,24 +11,189 @@ import (
 )
 
 func TestLeakPanics(t *testing.T) {
-	assert.Panics(t, leakPanic)
-	leaked := false
-	leakPanic = func() {
-		leaked = true
-	}
+	assert.PanicsWithError(t, (&LeakError{}).Error(),
+		func() { leakPanic(&LeakError{}) })
+	func() {
+		defer func() {
+			_, ok := recover().(*LeakError)
+			assert.True(t, ok)
+		}()
+		leakPanic(&LeakError{})
+	}()
+	var leaked int32
+	defer SetLeakHandler(nil)
+	SetLeakHandler(func(*LeakError) {
+		atomic.StoreInt32(&leaked, 1)
+	})
 	func() {
 		var pg Pinner
 		defer runtime.KeepAlive(pg)
 	}()
 	runtime.GC()
 	runtime.GC()
-	assert.False(t, leaked)
+	assert.Zero(t, atomic.LoadInt32(&leaked))
 	func() {
 		var pg Pinner
 		pg.Pin(&[1]byte{})
 	}()
 	runtime.GC()
 	runtime.GC()
-	assert.Eventually(t, func() bool { return leaked == true },
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&leaked) != 0 },
 		5*time.Second, 10*time.Millisecond)
 }
+
+func TestSetLeakHandler(t *testing.T) {
+	called := false
+	SetLeakHandler(func(*LeakError) { called = true })
+	LeakHandler()(&LeakError{})
+	assert.True(t, called)
+	SetLeakHandler(nil)
+	assert.PanicsWithError(t, (&LeakError{}).Error(),
+		func() { LeakHandler()(&LeakError{}) })
+}
+
+func TestLeakPins(t *testing.T) {
+	leaks := make(chan *LeakError, 1)
+	defer SetLeakHandler(nil)
+	SetLeakHandler(func(err *LeakError) {
+		// Don't block the finalizer go routine with further leaks.
+		select {
+		case leaks <- err:
+		default:
+		}
+	})
+	func() {
+		var pg Pinner
+		pg.PinAll(&[1]byte{}, &[1]byte{}, &[1]byte{})
+	}()
+	runtime.GC()
+	runtime.GC()
+	select {
+	case err := <-leaks:
+		assert.Equal(t, 3, err.Pins)
+		assert.Contains(t, err.Error(), "Found 3 leaking pinned pointer(s).")
+	case <-time.After(5 * time.Second):
+		t.Error("leak has not been detected")
+	}
+}
+
+// resetLeakCheckAtExit disables the registry of CheckLeaksAtExit() again and
+// empties it.
+func resetLeakCheckAtExit() {
+	activeMtx.Lock()
+	defer activeMtx.Unlock()
+	atomic.StoreInt32(&leakCheckAtExit, 0)
+	active = make(map[*data]struct{})
+}
+
+func TestCheckLeaksAtExit(t *testing.T) {
+	defer resetLeakCheckAtExit()
+	CheckLeaksAtExit()
+	var pg1, pg2, pg3 Pinner
+	pg1.Pin(&[1]byte{})
+	pg1.Unpin()
+	pg2.PinAll(&[1]byte{}, &[1]byte{}, &[1]byte{})
+	pg3.Pin(&[1]byte{})
+	pg2.Merge(&pg3)
+	leaks := Leaks()
+	if assert.Len(t, leaks, 1) {
+		assert.Equal(t, 4, leaks[0].Pins)
+	}
+	pg2.Unpin()
+	assert.Empty(t, Leaks())
+	// A Pinner reported by the leak check is not reported again.
+	reported := make(chan struct{}, 1)
+	defer SetLeakHandler(nil)
+	SetLeakHandler(func(*LeakError) {
+		select {
+		case reported <- struct{}{}:
+		default:
+		}
+	})
+	leakPinner()
+	runtime.GC()
+	runtime.GC()
+	select {
+	case <-reported:
+		assert.Empty(t, Leaks())
+	case <-time.After(5 * time.Second):
+		t.Error("leak has not been detected")
+	}
+}
+
+func leakPinner() {
+	var pg Pinner
+	pg.Pin(&[1]byte{})
+	// The stack of a released pin is not reported.
+	pg.Pin(&[1]byte{}).Unpin()
+}
+
+func TestLeakStacks(t *testing.T) {
+	leaks := make(chan *LeakError, 1)
+	defer SetLeakHandler(nil)
+	SetLeakHandler(func(err *LeakError) {
+		// Don't block the finalizer go routine with further leaks.
+		select {
+		case leaks <- err:
+		default:
+		}
+	})
+	defer SetDebug(false)
+	SetDebug(true)
+	leakPinner()
+	runtime.GC()
+	runtime.GC()
+	select {
+	case err := <-leaks:
+		if assert.Len(t, err.Stacks, 1) {
+			assert.Contains(t, err.Stacks[0], "ptrguard.leakPinner()")
+			assert.Contains(t, err.Error(), "ptrguard.leakPinner()")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("leak has not been detected")
+	}
+}
+
+func TestDisableLeakCheck(t *testing.T) {
+	// A leaked runtime.Pinner panics by itself.
+	defer SetBackend(CurrentBackend())
+	SetBackend(BackendQueue)
+	var leaked int32
+	defer SetLeakHandler(nil)
+	SetLeakHandler(func(*LeakError) {
+		atomic.StoreInt32(&leaked, 1)
+	})
+	func() {
+		var pg Pinner
+		pg.DisableLeakCheck()
+		pg.Pin(&[1]byte{})
+	}()
+	func() {
+		var pg Pinner
+		pg.Pin(&[1]byte{})
+		pg.DisableLeakCheck()
+	}()
+	runtime.GC()
+	runtime.GC()
+	time.Sleep(10 * time.Millisecond)
+	assert.Zero(t, atomic.LoadInt32(&leaked))
+}
+
+// BenchmarkLeakCheck pins an object with a new Pinner with and without leak
+// check.
+func BenchmarkLeakCheck(b *testing.B) {
+	for _, leakCheck := range []bool{true, false} {
+		b.Run(fmt.Sprintf("leakCheck=%t", leakCheck), func(b *testing.B) {
+			var obj [1]byte
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pg := &Pinner{}
+				if !leakCheck {
+					pg.DisableLeakCheck()
+				}
+				pg.Pin(&obj)
+				pg.Unpin()
+			}
+		})
+	}
+}
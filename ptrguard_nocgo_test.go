@@ -0,0 +1,30 @@
+//go:build !cgo
+// +build !cgo
+
+package ptrguard_test
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/ansiwen/ptrguard"
+	"github.com/ansiwen/ptrguard/ptrguardtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinWithoutCgo(t *testing.T) {
+	s := "fooBar"
+	slot, cleanup := ptrguardtest.FakeCSlot()
+	defer cleanup()
+	var pg ptrguard.Pinner
+	pg.Pin(&s).Store(slot)
+	assert.Equal(t, unsafe.Pointer(&s), *slot)
+	called := false
+	ptrguard.NoCheck(func() {
+		called = true
+	})
+	assert.True(t, called)
+	assert.Zero(t, ptrguard.CgoCheckLevel())
+	pg.Unpin()
+	assert.Zero(t, *slot)
+}
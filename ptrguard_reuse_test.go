@@ -0,0 +1,173 @@
+package ptrguard // nolint:testpackage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPutPinnerPreGrowsRefs(t *testing.T) {
+	var targets [8]unsafe.Pointer
+	var pg Pinner
+	for _, c := range []struct{ stores, peak int }{
+		{8, 8}, {3, 4}, {5, 5}, {0, 2}, {0, 1}, {0, 0},
+	} {
+		pp := pg.Pin(&targets)
+		assert.Equal(t, pg.peakRefs, cap(pg.refs.cPtr))
+		for i := 0; i < c.stores; i++ {
+			pp.Store(&targets[i])
+		}
+		pg.retire()
+		assert.Equal(t, c.peak, pg.peakRefs)
+	}
+	// A plain Unpin() doesn't record the peak.
+	pp := pg.Pin(&targets)
+	for i := range targets {
+		pp.Store(&targets[i])
+	}
+	pg.Unpin()
+	assert.Zero(t, pg.peakRefs)
+	pg.Pin(&targets)
+	assert.Zero(t, cap(pg.refs.cPtr))
+	pg.Unpin()
+}
+
+func TestGetPinner(t *testing.T) {
+	var targets [8]unsafe.Pointer
+	pg := GetPinner()
+	assert.False(t, pg.Active())
+	pp := pg.Pin(&targets)
+	for i := range targets {
+		pp.Store(&targets[i])
+	}
+	PutPinner(pg)
+	assert.False(t, pg.Active())
+	assert.Equal(t, len(targets), pg.peakRefs)
+	for i := range targets {
+		assert.Zero(t, targets[i])
+	}
+	// The pool might return a different or a new Pinner.
+	pg = GetPinner()
+	pg.Pin(&targets)
+	assert.Equal(t, pg.peakRefs, cap(pg.refs.cPtr))
+	PutPinner(pg)
+}
+
+func BenchmarkReusePinner(b *testing.B) {
+	var targets [256]unsafe.Pointer
+	var pg Pinner
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pp := pg.Pin(&targets)
+		for j := range targets {
+			pp.Store(&targets[j])
+		}
+		pg.Unpin()
+	}
+}
+
+// BenchmarkPinnerPool compares the steady state of GetPinner() and PutPinner()
+// with a plain sync.Pool of Pinners, that don't pre-grow their stored pointers.
+func BenchmarkPinnerPool(b *testing.B) {
+	var targets [256]unsafe.Pointer
+	store := func(pg *Pinner) {
+		pp := pg.Pin(&targets)
+		for j := range targets {
+			pp.Store(&targets[j])
+		}
+	}
+	b.Run("adaptive", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pg := GetPinner()
+			store(pg)
+			PutPinner(pg)
+		}
+	})
+	b.Run("plain", func(b *testing.B) {
+		pool := sync.Pool{New: func() interface{} { return &Pinner{} }}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pg := pool.Get().(*Pinner)
+			store(pg)
+			pg.Unpin()
+			pool.Put(pg)
+		}
+	})
+}
+
+func TestActive(t *testing.T) {
+	var pg Pinner
+	assert.False(t, pg.Active())
+	pg.Unpin()
+	assert.False(t, pg.Active())
+	pp := pg.Pin(new(int))
+	assert.True(t, pg.Active())
+	pp.Unpin()
+	assert.True(t, pg.Active())
+	pg.Unpin()
+	assert.False(t, pg.Active())
+	pg.Pin(new(int))
+	assert.True(t, pg.Active())
+	pg.UnpinAsync()
+	assert.False(t, pg.Active())
+	assert.False(t, NewPinner(8).Active())
+}
+
+func TestReset(t *testing.T) {
+	var targets [8]unsafe.Pointer
+	var pg Pinner
+	pg.Reset()
+	assert.Nil(t, pg.instance)
+	pp := pg.Pin(&targets)
+	for i := range targets {
+		pp.Store(&targets[i])
+	}
+	pg.Reset()
+	assert.Zero(t, pg.Len())
+	assert.Zero(t, pg.peakRefs)
+	for i := range targets {
+		assert.Zero(t, targets[i])
+	}
+	pg.Reset()
+	assert.Zero(t, pg.Len())
+	pg.Pin(&targets)
+	assert.Zero(t, cap(pg.refs.cPtr))
+	pg.Unpin()
+	pg.Reset()
+	assert.Zero(t, pg.Len())
+	assert.Nil(t, pg.data)
+}
+
+func TestNewPinner(t *testing.T) {
+	var targets [8]unsafe.Pointer
+	pg := NewPinner(16)
+	pg.Pin(&targets)
+	assert.Equal(t, 16, cap(pg.refs.cPtr))
+	pg.Reset()
+	pg.Pin(&targets)
+	assert.Equal(t, 16, cap(pg.refs.cPtr))
+	pg.Unpin()
+}
+
+// BenchmarkCapacityHint fills a new Pinner with 256 stored pointers, with and
+// without a capacity hint.
+func BenchmarkCapacityHint(b *testing.B) {
+	var targets [256]unsafe.Pointer
+	for _, hint := range []int{0, len(targets)} {
+		b.Run(fmt.Sprintf("hint=%d", hint), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pg := NewPinner(hint)
+				pp := pg.Pin(&targets)
+				for j := range targets {
+					pp.Store(&targets[j])
+				}
+				pg.Unpin()
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package ptrguard // nolint:testpackage
+
+import (
+	"errors"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreAfterUnpin(t *testing.T) {
+	s := "fooBar"
+	var target unsafe.Pointer
+	var pg Pinner
+	pp := pg.Pin(&s)
+	pp.Store(&target)
+	pg.Unpin()
+	assert.PanicsWithValue(t, ErrStoreAfterUnpin, func() { pp.Store(&target) })
+	assert.PanicsWithValue(t, ErrStoreAfterUnpin,
+		func() { pp.StoreCAS(&target, nil) })
+	assert.Zero(t, target)
+	pp = pg.Pin(&s)
+	pp.Unpin()
+	assert.PanicsWithValue(t, ErrStoreAfterUnpin, func() { pp.Store(&target) })
+	assert.Zero(t, target)
+	pg.Unpin()
+}
+
+func TestStoreStalePointer(t *testing.T) {
+	defer SetDebug(false)
+	SetDebug(true)
+	s := "fooBar"
+	var target unsafe.Pointer
+	var pg Pinner
+	defer pg.Unpin()
+	pp := pg.Pin(&s)
+	stale := *pp
+	pp.Unpin()
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			assert.True(t, errors.Is(err, ErrStalePointer))
+			assert.Equal(t, &StalePointerError{Ptr: unsafe.Pointer(&s)}, err)
+		}()
+		stale.Store(&target)
+	}()
+	assert.Zero(t, target)
+	// As long as the object is pinned by another pin, the pointer is valid.
+	pg.Pin(&s)
+	assert.NotPanics(t, func() { stale.Store(&target) })
+	assert.Equal(t, unsafe.Pointer(&s), target)
+	SetDebug(false)
+	pg.Unpin()
+	stale = *pg.Pin(&s)
+	pg.Pins()[0].Unpin()
+	assert.NotPanics(t, func() { stale.Store(&target) },
+		"the check is only done in debug mode")
+}
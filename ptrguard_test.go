@@ -1,7 +1,24 @@
+//go:build cgo
+// +build cgo
+
 package ptrguard_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
 	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
@@ -18,16 +35,39 @@ const (
 
 type tracer struct {
 	p *string
-	b *bool
+	b *int32 // set by the finalizer of p
 }
 
 func newTracer() tracer {
-	var b bool
+	var b int32
 	s := "foobar"
-	runtime.SetFinalizer(&s, func(interface{}) { b = true })
+	runtime.SetFinalizer(&s, func(interface{}) { atomic.StoreInt32(&b, 1) })
 	return tracer{&s, &b}
 }
 
+// finalized reports whether the object of the tracer has been finalized.
+func (tr tracer) finalized() bool {
+	return atomic.LoadInt32(tr.b) != 0
+}
+
+type blob []byte
+
+// requireCgoCheck skips tests, that need to disable cgocheck, when the level is
+// unknown, e.g. because the package has been built with the tag
+// ptrguard_nolinkname.
+func requireCgoCheck(t *testing.T) {
+	if ptrguard.CgoCheckLevel() < 0 {
+		t.Skip("cgocheck can't be disabled by ptrguard")
+	}
+}
+
+func newBytesTracer() ([]byte, *int32) {
+	var b int32
+	buf := make([]byte, 64)
+	runtime.SetFinalizer(&buf[0], func(interface{}) { atomic.StoreInt32(&b, 1) })
+	return buf, &b
+}
+
 func TestPin(t *testing.T) {
 	tr1 := newTracer()
 	tr2 := newTracer()
@@ -42,12 +82,12 @@ func TestPin(t *testing.T) {
 		tr2.p = nil
 		runtime.GC()
 		runtime.GC()
-		assert.False(t, *tr1.b)
-		assert.True(t, *tr2.b)
+		assert.False(t, tr1.finalized())
+		assert.True(t, tr2.finalized())
 	}()
 	runtime.GC()
 	runtime.GC()
-	assert.Eventually(t, func() bool { return *tr1.b == true },
+	assert.Eventually(t, func() bool { return tr1.finalized() },
 		5*time.Second, 10*time.Millisecond)
 	assert.Zero(t, *cPtr)
 }
@@ -63,11 +103,11 @@ func TestReusePinner(t *testing.T) {
 	tr1.p = nil
 	runtime.GC()
 	runtime.GC()
-	assert.False(t, *tr1.b)
+	assert.False(t, tr1.finalized())
 	p.Unpin()
 	runtime.GC()
 	runtime.GC()
-	assert.Eventually(t, func() bool { return *tr1.b == true },
+	assert.Eventually(t, func() bool { return tr1.finalized() },
 		5*time.Second, 10*time.Millisecond)
 	assert.Zero(t, *cPtr)
 	p.Pin(tr2.p).Store(cPtr)
@@ -75,11 +115,11 @@ func TestReusePinner(t *testing.T) {
 	tr2.p = nil
 	runtime.GC()
 	runtime.GC()
-	assert.False(t, *tr2.b)
+	assert.False(t, tr2.finalized())
 	p.Unpin()
 	runtime.GC()
 	runtime.GC()
-	assert.Eventually(t, func() bool { return *tr2.b == true },
+	assert.Eventually(t, func() bool { return tr2.finalized() },
 		5*time.Second, 10*time.Millisecond)
 	assert.Zero(t, *cPtr)
 }
@@ -104,6 +144,36 @@ func TestMultiStore(t *testing.T) {
 	}
 }
 
+func TestStoreAll(t *testing.T) {
+	goPtr := &[1]byte{}
+	cPtrArr := (*[1024]unsafe.Pointer)(Malloc(ptrSize * 1024))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	targets := make([]interface{}, len(cPtrArr))
+	for i := range cPtrArr {
+		targets[i] = &cPtrArr[i]
+	}
+	func() {
+		var pg ptrguard.Pinner
+		defer pg.Unpin()
+		pp := pg.Pin(goPtr)
+		pp.StoreAll(targets...)
+		for i := range cPtrArr {
+			assert.Equal(t, cPtrArr[i], unsafe.Pointer(goPtr))
+		}
+		assert.Equal(t, len(cPtrArr), pg.StoredCount())
+	}()
+	for i := range cPtrArr {
+		assert.Zero(t, cPtrArr[i])
+	}
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	assert.PanicsWithError(t,
+		"ptrguard: target 1: *int is not a pointer to a pointer",
+		func() { pg.Pin(goPtr).StoreAll(&cPtrArr[0], new(int)) })
+	assert.Zero(t, cPtrArr[0])
+	assert.Zero(t, pg.StoredCount())
+}
+
 func TestMultiPin(t *testing.T) {
 	var trs [1024]tracer
 	for i := range trs {
@@ -119,19 +189,20 @@ func TestMultiPin(t *testing.T) {
 		runtime.GC()
 		runtime.GC()
 		for i := range trs {
-			assert.False(t, *trs[i].b)
+			assert.False(t, trs[i].finalized())
 		}
 	}()
 	runtime.GC()
 	runtime.GC()
-	assert.Eventually(t, func() bool { return *trs[len(trs)-1].b == true },
+	assert.Eventually(t, func() bool { return trs[len(trs)-1].finalized() },
 		5*time.Second, 10*time.Millisecond)
 	for i := range trs {
-		assert.True(t, *trs[i].b)
+		assert.True(t, trs[i].finalized())
 	}
 }
 
 func TestNoCheck(t *testing.T) {
+	requireCgoCheck(t)
 	s := fooBar
 	goPtr := (unsafe.Pointer)(&s)
 	goPtrPtr := (unsafe.Pointer)(&goPtr)
@@ -163,6 +234,43 @@ func TestNoCheck(t *testing.T) {
 	)
 }
 
+func TestNoCheckPanic(t *testing.T) {
+	requireCgoCheck(t)
+	s := fooBar
+	goPtr := (unsafe.Pointer)(&s)
+	goPtrPtr := (unsafe.Pointer)(&goPtr)
+	assert.PanicsWithValue(t, "foo", func() {
+		ptrguard.NoCheck(func() {
+			DummyCCall(goPtrPtr)
+			panic("foo")
+		})
+	})
+	assert.Panics(t, func() { DummyCCall(goPtrPtr) })
+}
+
+func TestNoCheckContext(t *testing.T) {
+	requireCgoCheck(t)
+	s := fooBar
+	goPtr := (unsafe.Pointer)(&s)
+	goPtrPtr := (unsafe.Pointer)(&goPtr)
+	checked := func() (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		DummyCCall(goPtrPtr)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ptrguard.NoCheckContext(ctx, func() {
+		assert.False(t, checked())
+		cancel()
+		assert.Eventually(t, checked, 5*time.Second, 10*time.Millisecond)
+	})
+	assert.True(t, checked())
+	ptrguard.NoCheckContext(context.Background(), func() {
+		assert.False(t, checked())
+	})
+	assert.True(t, checked())
+}
+
 func TestUnintialized(t *testing.T) {
 	var pp ptrguard.Pinner
 	assert.NotPanics(t,
@@ -204,6 +312,16 @@ func TestPinNonPointerPanics(t *testing.T) {
 			pg.Pin(s)
 		},
 	)
+	assert.NotPanics(t,
+		func() {
+			pg.MustPin(&s)
+		},
+	)
+	assert.Panics(t,
+		func() {
+			pg.MustPin(s)
+		},
+	)
 }
 
 func TestStoreToNonPtrPtrPanics(t *testing.T) {
@@ -239,3 +357,1799 @@ func TestStoreToNonPtrPtrPanics(t *testing.T) {
 		},
 	)
 }
+
+func TestRangeTargets(t *testing.T) {
+	s1, s2 := fooBar, fooBar
+	cPtrArr := (*[3]unsafe.Pointer)(Malloc(ptrSize * 3))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	count := 0
+	pg.RangeTargets(func(_, _ unsafe.Pointer) bool {
+		count++
+		return true
+	})
+	assert.Zero(t, count)
+	pg.Pin(&s1).Store(&cPtrArr[0])
+	pg.Pin(&s2).Store(&cPtrArr[1])
+	pg.Pin(&s1).Store(&cPtrArr[2])
+	cPtrArr[1] = nil
+	var slots, values []unsafe.Pointer
+	pg.RangeTargets(func(slot, value unsafe.Pointer) bool {
+		slots = append(slots, slot)
+		values = append(values, value)
+		return true
+	})
+	assert.Equal(t, []unsafe.Pointer{
+		unsafe.Pointer(&cPtrArr[0]),
+		unsafe.Pointer(&cPtrArr[1]),
+		unsafe.Pointer(&cPtrArr[2]),
+	}, slots)
+	assert.Equal(t, []unsafe.Pointer{
+		unsafe.Pointer(&s1),
+		nil,
+		unsafe.Pointer(&s1),
+	}, values)
+	pg.RangeTargets(func(_, _ unsafe.Pointer) bool {
+		count++
+		return false
+	})
+	assert.Equal(t, 1, count)
+}
+
+func TestMaxStoredRefs(t *testing.T) {
+	s := fooBar
+	cPtrArr := (*[3]unsafe.Pointer)(Malloc(ptrSize * 3))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	pg.SetMaxStoredRefs(2)
+	pp := pg.Pin(&s)
+	assert.NotPanics(t,
+		func() {
+			pp.Store(&cPtrArr[0])
+			pp.Store(&cPtrArr[1])
+		},
+	)
+	assert.Panics(t,
+		func() {
+			pp.Store(&cPtrArr[2])
+		},
+	)
+	pg.Unpin()
+	pp = pg.Pin(&s)
+	assert.NotPanics(t,
+		func() {
+			pp.Store(&cPtrArr[0])
+			pp.Store(&cPtrArr[1])
+		},
+	)
+	pg.SetMaxStoredRefs(0)
+	assert.NotPanics(t,
+		func() {
+			pp.Store(&cPtrArr[2])
+		},
+	)
+}
+
+func TestRefsLimitHandler(t *testing.T) {
+	s := fooBar
+	cPtrArr := (*[3]unsafe.Pointer)(Malloc(ptrSize * 3))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	var spilled []int
+	defer ptrguard.SetRefsLimitHandler(nil)
+	ptrguard.SetRefsLimitHandler(func(err *ptrguard.RefsLimitError) {
+		spilled = append(spilled, err.Limit)
+	})
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	pg.SetMaxStoredRefs(1)
+	pp := pg.Pin(&s)
+	pp.Store(&cPtrArr[0])
+	assert.Empty(t, spilled)
+	pp.Store(&cPtrArr[1])
+	pp.Store(&cPtrArr[2])
+	assert.Equal(t, []int{1, 1}, spilled)
+	// The handler returned, so the pointers have been stored anyway.
+	assert.Equal(t, 3, pg.StoredCount())
+	assert.Equal(t, unsafe.Pointer(&s), cPtrArr[2])
+	pg.Unpin()
+	assert.Zero(t, cPtrArr[2])
+	ptrguard.SetRefsLimitHandler(nil)
+	assert.PanicsWithError(t, (&ptrguard.RefsLimitError{Limit: 1}).Error(),
+		func() { ptrguard.RefsLimitHandler()(&ptrguard.RefsLimitError{Limit: 1}) })
+}
+
+func TestBindTo(t *testing.T) {
+	tr := newTracer()
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	var pg1, pg2 ptrguard.Pinner
+	pg1.Pin(tr.p).BindTo(&pg2).Store(cPtr)
+	assert.Equal(t, unsafe.Pointer(tr.p), *cPtr)
+	tr.p = nil
+	pg1.Unpin()
+	runtime.GC()
+	runtime.GC()
+	assert.False(t, tr.finalized())
+	assert.NotZero(t, *cPtr)
+	pg2.Unpin()
+	assert.Zero(t, *cPtr)
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return tr.finalized() },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestPinLabels(t *testing.T) {
+	defer ptrguard.SetBackend(ptrguard.CurrentBackend())
+	ptrguard.SetBackend(ptrguard.BackendQueue)
+	s := fooBar
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	pg.Pin(&s)
+	var buf bytes.Buffer
+	err := pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), `"ptrguard-pin":"true"`)
+	assert.NotContains(t, buf.String(), `"ptrguard-addr"`)
+}
+
+func TestPinLabelsDebug(t *testing.T) {
+	defer ptrguard.SetDebug(false)
+	ptrguard.SetDebug(true)
+	for _, b := range []ptrguard.Backend{
+		ptrguard.BackendQueue, ptrguard.BackendGoroutine, ptrguard.BackendPool,
+	} {
+		t.Run(b.String(), func(t *testing.T) {
+			withBackend(b, func() {
+				s1, s2 := fooBar, fooBar
+				var pg ptrguard.Pinner
+				defer pg.Unpin()
+				pg.Pin(&s1)
+				pg.PinAll(&s2)
+				// The queue go routine labels itself after it received a pin.
+				assert.Eventually(t, func() bool {
+					var buf bytes.Buffer
+					err := pprof.Lookup("goroutine").WriteTo(&buf, 1)
+					return err == nil &&
+						strings.Contains(buf.String(), fmt.Sprintf("%p", &s1)) &&
+						strings.Contains(buf.String(), fmt.Sprintf("%p", &s2))
+				}, 5*time.Second, 10*time.Millisecond)
+			})
+		})
+	}
+}
+
+func TestAbsorb(t *testing.T) {
+	s := fooBar
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	freed := 0
+	var pg ptrguard.Pinner
+	pg.Absorb(func() {
+		assert.Zero(t, *cPtr)
+		freed++
+		Free(unsafe.Pointer(cPtr))
+	}, unsafe.Pointer(cPtr))
+	pg.Pin(&s).Store(cPtr)
+	assert.Zero(t, freed)
+	pg.Unpin()
+	assert.Equal(t, 1, freed)
+	pg.Unpin()
+	assert.Equal(t, 1, freed)
+}
+
+func TestAbsorbTwice(t *testing.T) {
+	cPtr1, cPtr2 := Malloc(ptrSize), Malloc(ptrSize)
+	defer Free(cPtr1)
+	defer Free(cPtr2)
+	freed := 0
+	free := func() { freed++ }
+	var pg ptrguard.Pinner
+	pg.Absorb(free, cPtr1, nil)
+	assert.Panics(t, func() { pg.Absorb(free, cPtr2, cPtr1) })
+	assert.Panics(t, func() { pg.Absorb(free, cPtr2, cPtr2) })
+	assert.NotPanics(t, func() { pg.Absorb(free, cPtr2, nil) })
+	pg.Unpin()
+	assert.Equal(t, 2, freed)
+	// After Unpin() the pointers have been freed, and the memory can be
+	// absorbed again, e.g. if malloc() returns the same address.
+	assert.NotPanics(t, func() { pg.Absorb(free, cPtr1) })
+	pg.Unpin()
+	assert.Equal(t, 3, freed)
+}
+
+func TestPinBytes(t *testing.T) {
+	buf1, b1 := newBytesTracer()
+	buf2, b2 := newBytesTracer()
+	msg := json.RawMessage(buf1)
+	bl := blob(buf2)
+	buf1, buf2 = nil, nil
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	func() {
+		var pg ptrguard.Pinner
+		defer pg.Unpin()
+		pg.PinBytes(msg).Store(cPtr)
+		assert.Equal(t, unsafe.Pointer(&msg[0]), *cPtr)
+		pg.PinBytes(bl)
+		pg.PinBytes(nil).Store(cPtr)
+		assert.Zero(t, *cPtr)
+		msg, bl = nil, nil
+		runtime.GC()
+		runtime.GC()
+		assert.Zero(t, atomic.LoadInt32(b1))
+		assert.Zero(t, atomic.LoadInt32(b2))
+	}()
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(b1) != 0 && atomic.LoadInt32(b2) != 0
+	},
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestStoreCAS(t *testing.T) {
+	s := fooBar
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	*cPtr = nil
+	var pg ptrguard.Pinner
+	pp := pg.Pin(&s)
+	assert.False(t, pp.StoreCAS(cPtr, unsafe.Pointer(&s)))
+	assert.Zero(t, *cPtr)
+	assert.True(t, pp.StoreCAS(cPtr, nil))
+	assert.Equal(t, unsafe.Pointer(&s), *cPtr)
+	assert.False(t, pp.StoreCAS(cPtr, nil))
+	pg.Unpin()
+	assert.Zero(t, *cPtr)
+}
+
+func TestStoreCASContended(t *testing.T) {
+	const n = 16
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	*cPtr = nil
+	var pgs [n]ptrguard.Pinner
+	var won [n]bool
+	var wg sync.WaitGroup
+	for i := range pgs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			won[i] = pgs[i].Pin(&[1]byte{}).StoreCAS(cPtr, nil)
+		}(i)
+	}
+	wg.Wait()
+	winners := 0
+	for i := range pgs {
+		if won[i] {
+			winners++
+		}
+		pgs[i].Unpin()
+	}
+	assert.Equal(t, 1, winners)
+	assert.Zero(t, *cPtr)
+}
+
+func TestStoreCASLimit(t *testing.T) {
+	s := fooBar
+	cPtrArr := (*[2]unsafe.Pointer)(Malloc(ptrSize * 2))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	cPtrArr[0], cPtrArr[1] = nil, nil
+	var pg ptrguard.Pinner
+	pg.SetMaxStoredRefs(1)
+	pp := pg.Pin(&s)
+	assert.True(t, pp.StoreCAS(&cPtrArr[0], nil))
+	// The limit is checked before the swap, so nothing is left in the slot.
+	assert.PanicsWithError(t, (&ptrguard.RefsLimitError{Limit: 1}).Error(),
+		func() { pp.StoreCAS(&cPtrArr[1], nil) })
+	assert.Zero(t, cPtrArr[1])
+	assert.Equal(t, 1, pg.StoredCount())
+	pg.Unpin()
+	assert.Zero(t, cPtrArr[0])
+}
+
+func TestStoreCASUnpin(t *testing.T) {
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	for i := 0; i < 100; i++ {
+		*cPtr = nil
+		var pg ptrguard.Pinner
+		pp := pg.Pin(&[1]byte{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer func() {
+				if r := recover(); r != nil {
+					assert.Equal(t, ptrguard.ErrStoreAfterUnpin, r)
+				}
+			}()
+			pp.StoreCAS(cPtr, nil)
+		}()
+		pp.Unpin()
+		<-done
+		// Either the pointer has been stored before Unpin() and zeroed by it,
+		// or StoreCAS() has panicked without storing it.
+		assert.Zero(t, *cPtr)
+		pg.Unpin()
+	}
+}
+
+func TestSinglePinGoroutine(t *testing.T) {
+	defer ptrguard.SetBackend(ptrguard.CurrentBackend())
+	ptrguard.SetBackend(ptrguard.BackendQueue)
+	var trs [64]tracer
+	for i := range trs {
+		trs[i] = newTracer()
+	}
+	n := runtime.NumGoroutine()
+	var pg ptrguard.Pinner
+	for i := range trs {
+		pg.Pin(trs[i].p)
+		trs[i].p = nil
+	}
+	assert.Equal(t, n+1, runtime.NumGoroutine())
+	runtime.GC()
+	runtime.GC()
+	for i := range trs {
+		assert.False(t, trs[i].finalized())
+	}
+	pg.Unpin()
+	// The condition of assert.Eventually() runs in its own go routine.
+	assert.Eventually(t, func() bool { return runtime.NumGoroutine() == n+1 },
+		5*time.Second, 10*time.Millisecond)
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return trs[len(trs)-1].finalized() },
+		5*time.Second, 10*time.Millisecond)
+}
+
+type callbackContext struct {
+	name  string
+	calls int
+}
+
+func TestPinContext(t *testing.T) {
+	var finalized int32
+	ctx := &callbackContext{name: fooBar}
+	runtime.SetFinalizer(ctx, func(interface{}) { atomic.StoreInt32(&finalized, 1) })
+	callback := func(arg unsafe.Pointer) {
+		ctx := (*callbackContext)(arg)
+		ctx.calls++
+		assert.Equal(t, fooBar, ctx.name)
+	}
+	// simulate C keeping the opaque argument of the callback
+	cArg := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cArg))
+	var pg ptrguard.Pinner
+	*cArg = pg.PinContext(ctx)
+	ctx = nil
+	runtime.GC()
+	runtime.GC()
+	assert.Zero(t, atomic.LoadInt32(&finalized))
+	callback(*cArg)
+	callback(*cArg)
+	assert.Equal(t, 2, (*callbackContext)(*cArg).calls)
+	*cArg = nil
+	pg.Unpin()
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&finalized) != 0 },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestString(t *testing.T) {
+	s := fooBar
+	var targets [3]unsafe.Pointer
+	var pg ptrguard.Pinner
+	assert.Equal(t, "Pinner{pinned:0, stored:0}", pg.String())
+	pp1 := pg.Pin(&s)
+	pp2 := pg.Pin(&targets)
+	assert.Equal(t, fmt.Sprintf("Pinned{%p, stored:0}", &s), pp1.String())
+	pp1.Store(&targets[0])
+	for i := 1; i < len(targets); i++ {
+		pp2.Store(&targets[i])
+	}
+	assert.Equal(t, fmt.Sprintf("Pinned{%p, stored:1}", &s), pp1.String())
+	assert.Equal(t, fmt.Sprintf("Pinned{%p, stored:2}", &targets), fmt.Sprint(pp2))
+	assert.Equal(t, "Pinner{pinned:2, stored:3}", fmt.Sprint(&pg))
+	assert.Equal(t, "Pinned{nil}", pg.PinBytes(nil).String())
+	var nilPinned *ptrguard.Pinned
+	assert.Equal(t, "Pinned{nil}", nilPinned.String())
+	pg.Unpin()
+	assert.Equal(t, "Pinner{pinned:0, stored:0}", pg.String())
+}
+
+func TestPinAutoRelease(t *testing.T) {
+	tr1 := newTracer()
+	tr2 := newTracer()
+	var pg ptrguard.Pinner
+	pp2 := pg.Pin(tr2.p)
+	func() {
+		pp1 := pg.PinAutoRelease(tr1.p)
+		tr1.p = nil
+		runtime.GC()
+		runtime.GC()
+		assert.False(t, tr1.finalized())
+		assert.Equal(t, 2, pg.Len())
+		runtime.KeepAlive(pp1)
+	}()
+	tr2.p = nil
+	assert.Eventually(t,
+		func() bool {
+			runtime.GC()
+			return tr1.finalized()
+		},
+		5*time.Second, 10*time.Millisecond)
+	// The other pins of the Pinner are not affected.
+	assert.False(t, tr2.finalized())
+	assert.Equal(t, 1, pg.Len())
+	assert.Equal(t, []*ptrguard.Pinned{pp2}, pg.Pins())
+	pg.Unpin()
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, tr2.finalized, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestUnpinZeroesMixedTargets(t *testing.T) {
+	goPtr := &[1]byte{}
+	cPtrArr := (*[16]unsafe.Pointer)(Malloc(ptrSize * 16))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	for i := range cPtrArr {
+		cPtrArr[i] = nil
+	}
+	var pg ptrguard.Pinner
+	pp := pg.Pin(goPtr)
+	stored := []int{3, 4, 5, 0, 9, 8, 7, 10, 11, 15}
+	for _, i := range stored {
+		if i == 4 {
+			// An atomic target interrupts the run of adjacent targets.
+			pp.StoreAtomic(&cPtrArr[i])
+		} else {
+			pp.Store(&cPtrArr[i])
+		}
+	}
+	marker := unsafe.Pointer(&[1]byte{})
+	for _, i := range []int{1, 2, 6, 12, 13, 14} {
+		cPtrArr[i] = marker
+	}
+	pg.Unpin()
+	for i := range cPtrArr {
+		switch i {
+		case 1, 2, 6, 12, 13, 14:
+			assert.Equal(t, marker, cPtrArr[i])
+		default:
+			assert.Zero(t, cPtrArr[i])
+		}
+	}
+	runtime.KeepAlive(marker)
+}
+
+func BenchmarkUnpinContiguous(b *testing.B) {
+	const n = 1 << 20
+	cPtrArr := (*[n]unsafe.Pointer)(Malloc(ptrSize * n))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	goPtr := &[1]byte{}
+	var pg ptrguard.Pinner
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		pp := pg.Pin(goPtr)
+		for j := range cPtrArr {
+			pp.Store(&cPtrArr[j])
+		}
+		// Don't measure the garbage collection of the stores.
+		runtime.GC()
+		b.StartTimer()
+		pg.Unpin()
+	}
+}
+
+func TestZeroOnUnpin(t *testing.T) {
+	cPtrArr := (*[2]unsafe.Pointer)(Malloc(ptrSize * 2))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	s := fooBar
+	var pg ptrguard.Pinner
+	pg.SetZeroOnUnpin(false)
+	pp := pg.Pin(&s)
+	pp.Store(&cPtrArr[0])
+	pp.Store(&cPtrArr[1])
+	pp.Clear(&cPtrArr[1])
+	assert.Zero(t, cPtrArr[1])
+	pg.Unpin()
+	assert.Equal(t, unsafe.Pointer(&s), cPtrArr[0])
+	// The setting is kept, when the Pinner is reused.
+	pg.Pin(&s).Store(&cPtrArr[1])
+	pg.Unpin()
+	assert.Equal(t, unsafe.Pointer(&s), cPtrArr[1])
+	pg.SetZeroOnUnpin(true)
+	pg.Pin(&s).Store(&cPtrArr[0])
+	pg.Unpin()
+	assert.Zero(t, cPtrArr[0])
+	runtime.KeepAlive(&s)
+}
+
+// BenchmarkZeroOnUnpin stores a pinned pointer at many non-contiguous targets,
+// that can't be zeroed in bulk, and unpins them with and without zeroing.
+func BenchmarkZeroOnUnpin(b *testing.B) {
+	const n = 1 << 14
+	cPtrArr := (*[2 * n]unsafe.Pointer)(Malloc(ptrSize * 2 * n))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	goPtr := &[1]byte{}
+	for _, zero := range []bool{true, false} {
+		b.Run(fmt.Sprintf("zero=%v", zero), func(b *testing.B) {
+			var pg ptrguard.Pinner
+			pg.SetZeroOnUnpin(zero)
+			for i := 0; i < b.N; i++ {
+				pp := pg.Pin(goPtr)
+				for j := 0; j < n; j++ {
+					pp.StorePointer(&cPtrArr[2*j])
+				}
+				pg.Unpin()
+			}
+		})
+	}
+}
+
+// goIovec has the memory layout of Iovec.
+type goIovec struct {
+	Base unsafe.Pointer
+	Len  int32
+}
+
+func TestFieldOffsets(t *testing.T) {
+	offsets := ptrguard.FieldOffsets(reflect.TypeOf(goIovec{}))
+	assert.Equal(t, map[string]uintptr{"Base": 0, "Len": ptrSize}, offsets)
+	assert.Panics(t,
+		func() {
+			ptrguard.FieldOffsets(reflect.TypeOf(&goIovec{}))
+		},
+	)
+}
+
+func TestStoreField(t *testing.T) {
+	buf := make([]byte, 8)
+	cPtr := Malloc(SizeOfIovec)
+	defer Free(cPtr)
+	iovec := (*Iovec)(cPtr)
+	iovec.Base = nil
+	iovecType := reflect.TypeOf(goIovec{})
+	var pg ptrguard.Pinner
+	pp := pg.PinBytes(buf)
+	pp.StoreField(cPtr, iovecType, "Base")
+	assert.Equal(t, unsafe.Pointer(&buf[0]), iovec.Base)
+	assert.Panics(t,
+		func() {
+			pp.StoreField(cPtr, iovecType, "Len")
+		},
+	)
+	assert.Panics(t,
+		func() {
+			pp.StoreField(cPtr, iovecType, "Foo")
+		},
+	)
+	pg.Unpin()
+	assert.Zero(t, iovec.Base)
+}
+
+func TestStoreStructField(t *testing.T) {
+	buf := make([]byte, 8)
+	iovec := &goIovec{}
+	var pg ptrguard.Pinner
+	pp := pg.PinBytes(buf)
+	pp.StoreStructField(iovec, "Base")
+	assert.Equal(t, unsafe.Pointer(&buf[0]), iovec.Base)
+	cIovec := (*goIovec)(Malloc(SizeOfIovec))
+	defer Free(unsafe.Pointer(cIovec))
+	cIovec.Base = nil
+	pp.StoreStructField(cIovec, "Base")
+	assert.Equal(t, unsafe.Pointer(&buf[0]), cIovec.Base)
+	assert.Equal(t, 2, pg.StoredCount())
+	assert.PanicsWithValue(t, "field Len of ptrguard_test.goIovec is not a pointer",
+		func() { pp.StoreStructField(iovec, "Len") })
+	assert.PanicsWithValue(t, "ptrguard_test.goIovec has no field Foo",
+		func() { pp.StoreStructField(iovec, "Foo") })
+	assert.PanicsWithValue(t, "ptrguard_test.goIovec is not a pointer to a struct",
+		func() { pp.StoreStructField(*iovec, "Base") })
+	assert.Panics(t, func() { pp.StoreStructField(&buf, "Base") })
+	pg.Unpin()
+	assert.Zero(t, iovec.Base)
+	assert.Zero(t, cIovec.Base)
+}
+
+func TestStoreLog(t *testing.T) {
+	s1, s2 := fooBar, fooBar
+	var targets [3]unsafe.Pointer
+	assert.Nil(t, ptrguard.RecentStores())
+	ptrguard.EnableStoreLog(2)
+	defer ptrguard.EnableStoreLog(0)
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	pg.Pin(&s1).Store(&targets[0])
+	assert.Len(t, ptrguard.RecentStores(), 1)
+	pg.Pin(&s2).Store(&targets[1])
+	pg.Pin(&s1).Store(&targets[2])
+	records := ptrguard.RecentStores()
+	assert.Len(t, records, 2)
+	assert.Equal(t, uintptr(unsafe.Pointer(&targets[1])), records[0].Slot)
+	assert.Equal(t, uintptr(unsafe.Pointer(&s2)), records[0].Pointer)
+	assert.Equal(t, uintptr(unsafe.Pointer(&targets[2])), records[1].Slot)
+	assert.Equal(t, uintptr(unsafe.Pointer(&s1)), records[1].Pointer)
+	assert.Contains(t, records[1].CallSite, "ptrguard_test.go:")
+	ptrguard.EnableStoreLog(0)
+	assert.Nil(t, ptrguard.RecentStores())
+}
+
+func TestPinnedBytes(t *testing.T) {
+	var pg ptrguard.Pinner
+	assert.Zero(t, pg.PinnedBytes())
+	for _, n := range []int{3, 100, 4096} {
+		pg.PinBytes(make([]byte, n))
+	}
+	pg.PinBytes(nil)
+	pg.Pin(&[16]byte{})
+	assert.Equal(t, 4199, pg.PinnedBytes())
+	pg.Unpin()
+	assert.Zero(t, pg.PinnedBytes())
+	pg.PinBytes(make([]byte, 10))
+	assert.Equal(t, 10, pg.PinnedBytes())
+	pg.Unpin()
+}
+
+func TestPinSliceElements(t *testing.T) {
+	var finalized int32
+	elems := make([]goIovec, 8)
+	runtime.SetFinalizer(&elems[0], func(interface{}) {
+		atomic.StoreInt32(&finalized, 1)
+	})
+	cPtrArr := (*[8]unsafe.Pointer)(Malloc(ptrSize * 8))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	var pg ptrguard.Pinner
+	pinned := pg.PinSliceElements(elems)
+	assert.Len(t, pinned, len(elems))
+	assert.Equal(t, "Pinner{pinned:8, stored:0}", pg.String())
+	for i := range pinned {
+		pinned[i].Store(&cPtrArr[i])
+		assert.Equal(t, unsafe.Pointer(&elems[i]), cPtrArr[i])
+	}
+	elems = nil
+	runtime.GC()
+	runtime.GC()
+	assert.Zero(t, atomic.LoadInt32(&finalized))
+	pg.Unpin()
+	for i := range cPtrArr {
+		assert.Zero(t, cPtrArr[i])
+	}
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&finalized) != 0 },
+		5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, pg.PinSliceElements([]int{}))
+	assert.Panics(t,
+		func() {
+			pg.PinSliceElements(&[1]int{})
+		},
+	)
+}
+
+func TestPinSliceElementsUnpin(t *testing.T) {
+	var finalized int32
+	elems := make([]goIovec, 4)
+	runtime.SetFinalizer(&elems[0], func(interface{}) {
+		atomic.StoreInt32(&finalized, 1)
+	})
+	cPtrArr := (*[4]unsafe.Pointer)(Malloc(ptrSize * 4))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	pinned := pg.PinSliceElements(elems)
+	elems = nil
+	for i := range pinned {
+		pinned[i].Store(&cPtrArr[i])
+	}
+	// Unpinning single elements keeps the array pinned for the others.
+	for _, pp := range pinned[:3] {
+		pp.Unpin()
+	}
+	assert.Equal(t, 1, pg.Len())
+	runtime.GC()
+	runtime.GC()
+	assert.Zero(t, atomic.LoadInt32(&finalized))
+	assert.Equal(t, [4]unsafe.Pointer{nil, nil, nil, pinned[3].Pointer()}, *cPtrArr)
+	pinned[3].Store(&cPtrArr[0])
+	pinned[3].Unpin()
+	assert.Zero(t, pg.Len())
+	assert.Equal(t, [4]unsafe.Pointer{}, *cPtrArr)
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&finalized) != 0 },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestUnpinAsync(t *testing.T) {
+	tr := newTracer()
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	freed := false
+	var pg ptrguard.Pinner
+	assert.False(t, pg.Draining())
+	pg.Absorb(func() { freed = true })
+	pg.Pin(tr.p).Store(cPtr)
+	tr.p = nil
+	assert.False(t, pg.Draining())
+	pg.UnpinAsync()
+	assert.Zero(t, *cPtr)
+	assert.Eventually(t, func() bool { return !pg.Draining() },
+		5*time.Second, 10*time.Millisecond)
+	assert.True(t, freed)
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return tr.finalized() },
+		5*time.Second, 10*time.Millisecond)
+	pg.Pin(&[1]byte{})
+	pg.Unpin()
+	assert.False(t, pg.Draining())
+}
+
+func TestWaitReleased(t *testing.T) {
+	var pg1, pg2 ptrguard.Pinner
+	pp1 := pg1.Pin(&[1]byte{})
+	pp2 := pg2.Pin(&[1]byte{})
+	released := make(chan struct{})
+	go func() {
+		ptrguard.WaitReleased(pp1, pp2, pg1.PinBytes(nil))
+		close(released)
+	}()
+	pg1.Unpin()
+	select {
+	case <-released:
+		t.Error("released before all Pinners were unpinned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pg2.UnpinAsync()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Error("not released after all Pinners were unpinned")
+	}
+	ptrguard.WaitReleased(pp1, pp2)
+}
+
+func TestWaitReleasedPinned(t *testing.T) {
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	pp1 := pg.Pin(&[1]byte{})
+	pp2 := pg.Pin(&[1]byte{})
+	released := make(chan struct{})
+	go func() {
+		ptrguard.WaitReleased(pp1, pp2)
+		close(released)
+	}()
+	pp1.Unpin()
+	select {
+	case <-released:
+		t.Error("released before all Pinned values were unpinned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pp2.Unpin()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Error("not released after all Pinned values were unpinned")
+	}
+	assert.True(t, pg.Active())
+	// Merging moves the pin, so it is not released by the other Pinner.
+	var other ptrguard.Pinner
+	pp3 := other.Pin(&[1]byte{})
+	released = make(chan struct{})
+	go func() {
+		ptrguard.WaitReleased(pp3)
+		close(released)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	pg.Merge(&other)
+	select {
+	case <-released:
+		t.Error("released by Merge()")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pg.Unpin()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Error("not released after the merged Pinner was unpinned")
+	}
+}
+
+func TestSwap(t *testing.T) {
+	var trs [4]tracer
+	for i := range trs {
+		trs[i] = newTracer()
+	}
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	var pg ptrguard.Pinner
+	for i := range trs {
+		pg.Swap(cPtr, trs[i].p)
+		assert.Equal(t, unsafe.Pointer(trs[i].p), *cPtr)
+		trs[i].p = nil
+		assert.Equal(t, "Pinner{pinned:1, stored:1}", pg.String())
+	}
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return trs[len(trs)-2].finalized() },
+		5*time.Second, 10*time.Millisecond)
+	for i := 0; i < len(trs)-1; i++ {
+		assert.True(t, trs[i].finalized())
+	}
+	assert.False(t, trs[len(trs)-1].finalized())
+	pg.Unpin()
+	assert.Zero(t, *cPtr)
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return trs[len(trs)-1].finalized() },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestSwapLimit(t *testing.T) {
+	s1, s2 := fooBar, fooBar
+	cPtrArr := (*[2]unsafe.Pointer)(Malloc(ptrSize * 2))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	cPtrArr[0], cPtrArr[1] = nil, nil
+	var pg ptrguard.Pinner
+	pg.SetMaxStoredRefs(1)
+	pg.Pin(&s1).Store(&cPtrArr[0])
+	// The limit is checked before the swap, so nothing is left in the slot.
+	assert.PanicsWithError(t, (&ptrguard.RefsLimitError{Limit: 1}).Error(),
+		func() { pg.Swap(&cPtrArr[1], &s2) })
+	assert.Zero(t, cPtrArr[1])
+	assert.Equal(t, 1, pg.StoredCount())
+	pg.SetMaxStoredRefs(0)
+	pg.Swap(&cPtrArr[1], &s2)
+	assert.Equal(t, unsafe.Pointer(&s2), cPtrArr[1])
+	pg.Unpin()
+	assert.Equal(t, [2]unsafe.Pointer{}, *cPtrArr)
+}
+
+func TestSwapUnpin(t *testing.T) {
+	trs := [3]tracer{newTracer(), newTracer(), newTracer()}
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	var pinned [3]*ptrguard.Pinned
+	for i := range trs {
+		pinned[i] = pg.Swap(cPtr, trs[i].p)
+		trs[i].p = nil
+	}
+	// The previous Pinned values are unpinned already, so they don't zero the
+	// slot, that now holds the last object.
+	pinned[0].Unpin()
+	assert.Equal(t, pinned[2].Pointer(), *cPtr)
+	assert.Equal(t, "Pinner{pinned:1, stored:1}", pg.String())
+	assert.PanicsWithValue(t, ptrguard.ErrStoreAfterUnpin,
+		func() { pinned[1].Store(cPtr) })
+	// Unpinning the last one zeroes the slot, before its object is released.
+	pinned[2].Unpin()
+	pinned[2] = nil
+	assert.Zero(t, *cPtr)
+	assert.Equal(t, "Pinner{pinned:0, stored:0}", pg.String())
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return trs[2].finalized() },
+		5*time.Second, 10*time.Millisecond)
+	// After that the slot is registered freshly.
+	s := fooBar
+	pg.Swap(cPtr, &s)
+	assert.Equal(t, "Pinner{pinned:1, stored:1}", pg.String())
+	pg.Unpin()
+	assert.Zero(t, *cPtr)
+}
+
+func TestForEachPinned(t *testing.T) {
+	var pg ptrguard.Pinner
+	var expected []unsafe.Pointer
+	collect := func() []unsafe.Pointer {
+		var ptrs []unsafe.Pointer
+		pg.ForEachPinned(func(ptr unsafe.Pointer) {
+			ptrs = append(ptrs, ptr)
+		})
+		return ptrs
+	}
+	assert.Empty(t, collect())
+	for i := 0; i < 10; i++ {
+		ptr := unsafe.Pointer(new(int))
+		pg.Pin(ptr)
+		expected = append(expected, ptr)
+	}
+	pg.PinBytes(nil)
+	assert.Equal(t, expected, collect())
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	first, second := unsafe.Pointer(new(int)), unsafe.Pointer(new(int))
+	pg.Swap(cPtr, first)
+	assert.Equal(t, append(expected, first), collect())
+	pg.Swap(cPtr, second)
+	assert.Equal(t, append(expected, second), collect())
+	pg.Unpin()
+	assert.Empty(t, collect())
+}
+
+func TestPins(t *testing.T) {
+	var pg ptrguard.Pinner
+	assert.Empty(t, pg.Pins())
+	var expected []*ptrguard.Pinned
+	for i := 0; i < 5; i++ {
+		expected = append(expected, pg.Pin(new(int)))
+	}
+	pg.PinBytes(nil)
+	pins := pg.Pins()
+	assert.Equal(t, expected, pins)
+	expected[1].Unpin()
+	assert.Equal(t, append(expected[:1:1], expected[2:]...), pg.Pins())
+	assert.Equal(t, expected, pins)
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	first := pg.Swap(cPtr, new(int))
+	assert.Contains(t, pg.Pins(), first)
+	second := pg.Swap(cPtr, new(int))
+	assert.NotContains(t, pg.Pins(), first)
+	assert.Contains(t, pg.Pins(), second)
+
+	var other ptrguard.Pinner
+	merged := other.Pin(new(int))
+	slot := new(unsafe.Pointer)
+	merged.Store(slot)
+	pg.Merge(&other)
+	assert.Len(t, pg.Pins(), 6)
+	assert.Contains(t, pg.Pins(), merged)
+	assert.Empty(t, other.Pins())
+	merged.Unpin()
+	assert.Zero(t, *slot)
+	assert.Len(t, pg.Pins(), 5)
+	assert.Equal(t, 5, pg.Len())
+	pg.Unpin()
+	assert.Empty(t, pg.Pins())
+}
+
+func TestWithPinnedRetry(t *testing.T) {
+	tr1, tr2 := newTracer(), newTracer()
+	ptrs := []interface{}{tr1.p, tr2.p}
+	tr1.p, tr2.p = nil, nil
+	var pg ptrguard.Pinner
+	calls := 0
+	pg.WithPinnedRetry(ptrs, func() bool {
+		calls++
+		runtime.GC()
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		assert.False(t, tr1.finalized())
+		assert.False(t, tr2.finalized())
+		assert.Equal(t, "Pinner{pinned:2, stored:0}", pg.String())
+		return calls < 5
+	})
+	assert.Equal(t, 5, calls)
+	assert.Equal(t, "Pinner{pinned:0, stored:0}", pg.String())
+	ptrs = nil
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return tr1.finalized() && tr2.finalized() },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestCopyTargets(t *testing.T) {
+	const n = 3
+	const stride = 2 * ptrSize
+	src := Malloc(n * ptrSize)
+	defer Free(src)
+	dst := Malloc(n * stride)
+	defer Free(dst)
+	srcSlot := func(i int) *unsafe.Pointer {
+		return (*unsafe.Pointer)(unsafe.Pointer(uintptr(src) + uintptr(i)*ptrSize))
+	}
+	dstSlot := func(i int) *unsafe.Pointer {
+		return (*unsafe.Pointer)(unsafe.Pointer(uintptr(dst) + uintptr(i)*stride))
+	}
+	var pg ptrguard.Pinner
+	pg.CopyTargets(dst, stride)
+	var ptrs [n]unsafe.Pointer
+	for i := range ptrs {
+		ptrs[i] = unsafe.Pointer(new(int))
+		pg.Pin(ptrs[i]).Store(srcSlot(i))
+	}
+	pg.CopyTargets(dst, stride)
+	for i := range ptrs {
+		assert.Equal(t, ptrs[i], *dstSlot(i))
+	}
+	pg.Unpin()
+	for i := range ptrs {
+		assert.Zero(t, *srcSlot(i))
+		assert.Equal(t, ptrs[i], *dstSlot(i))
+	}
+}
+
+func TestPinRaw(t *testing.T) {
+	tr := newTracer()
+	release := ptrguard.PinRaw(tr.p)
+	tr.p = nil
+	runtime.GC()
+	runtime.GC()
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, tr.finalized())
+	release()
+	release()
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return tr.finalized() },
+		5*time.Second, 10*time.Millisecond)
+	assert.Panics(t, func() { ptrguard.PinRaw(42) })
+}
+
+func TestLen(t *testing.T) {
+	var pg ptrguard.Pinner
+	assert.Zero(t, pg.Len())
+	for i := 1; i <= 3; i++ {
+		pg.Pin(new(int))
+		assert.Equal(t, i, pg.Len())
+	}
+	pg.PinBytes(nil)
+	assert.Equal(t, 3, pg.Len())
+	pg.Unpin()
+	assert.Zero(t, pg.Len())
+}
+
+func TestStoredCount(t *testing.T) {
+	const n = 4
+	cPtr := Malloc(n * ptrSize)
+	defer Free(cPtr)
+	var pg ptrguard.Pinner
+	assert.Zero(t, pg.StoredCount())
+	pinned := pg.Pin(new(int))
+	assert.Zero(t, pg.StoredCount())
+	for i := 0; i < n; i++ {
+		pinned.Store((*unsafe.Pointer)(unsafe.Pointer(uintptr(cPtr) + uintptr(i)*ptrSize)))
+		assert.Equal(t, i+1, pg.StoredCount())
+	}
+	assert.Equal(t, 1, pg.Len())
+	pg.Unpin()
+	assert.Zero(t, pg.StoredCount())
+}
+
+func TestScope(t *testing.T) {
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	s := fooBar
+	ptrguard.Scope(func(pg *ptrguard.Pinner) {
+		pg.Pin(&s).Store(cPtr)
+		assert.Equal(t, unsafe.Pointer(&s), *cPtr)
+	})
+	assert.Zero(t, *cPtr)
+	assert.PanicsWithValue(t, "foo", func() {
+		ptrguard.Scope(func(pg *ptrguard.Pinner) {
+			pg.Pin(&s).Store(cPtr)
+			assert.Equal(t, unsafe.Pointer(&s), *cPtr)
+			panic("foo")
+		})
+	})
+	assert.Zero(t, *cPtr)
+}
+
+func TestDo(t *testing.T) {
+	var buffers [][]byte
+	var ptrs []interface{}
+	for i := 2; i < 12; i += 3 {
+		buffers = append(buffers, make([]byte, i))
+		ptrs = append(ptrs, &buffers[len(buffers)-1][0])
+	}
+	n := len(buffers)
+	cIovec := (*[4]Iovec)(Malloc(SizeOfIovec * 4))
+	defer Free(unsafe.Pointer(cIovec))
+	ptrguard.Do(ptrs, func(pins []*ptrguard.Pinned) {
+		if !assert.Len(t, pins, n) {
+			return
+		}
+		for i := range pins {
+			pins[i].Store(&cIovec[i].Base)
+			cIovec[i].Len = Int(len(buffers[i]))
+		}
+		FillBuffersWithX(&cIovec[0], n)
+	})
+	for i := range buffers {
+		assert.Equal(t, strings.Repeat("X", len(buffers[i])), string(buffers[i]))
+		assert.Zero(t, cIovec[i].Base)
+	}
+	assert.PanicsWithValue(t, "foo", func() {
+		ptrguard.Do(ptrs, func(pins []*ptrguard.Pinned) {
+			pins[0].Store(&cIovec[0].Base)
+			panic("foo")
+		})
+	})
+	assert.Zero(t, cIovec[0].Base)
+	called := false
+	assert.PanicsWithError(t, "ptrguard: argument 1: int is not a pointer",
+		func() {
+			ptrguard.Do([]interface{}{ptrs[0], 42}, func([]*ptrguard.Pinned) {
+				called = true
+			})
+		})
+	assert.False(t, called)
+}
+
+func TestNoCheckErr(t *testing.T) {
+	requireCgoCheck(t)
+	s := fooBar
+	goPtr := (unsafe.Pointer)(&s)
+	goPtrPtr := (unsafe.Pointer)(&goPtr)
+	errFoo := errors.New("foo")
+	err := ptrguard.NoCheckErr(func() error {
+		DummyCCall(goPtrPtr)
+		return errFoo
+	})
+	assert.Equal(t, errFoo, err)
+	assert.NoError(t, ptrguard.NoCheckErr(func() error { return nil }))
+	assert.Panics(t, func() {
+		_ = ptrguard.NoCheckErr(func() error { panic("foo") })
+	})
+	assert.Panics(t, func() { DummyCCall(goPtrPtr) })
+}
+
+func TestPinnedPointer(t *testing.T) {
+	s := fooBar
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	assert.Equal(t, unsafe.Pointer(&s), pg.Pin(&s).Pointer())
+	assert.Equal(t, unsafe.Pointer(&s), pg.Pin(unsafe.Pointer(&s)).Pointer())
+	assert.Zero(t, pg.PinBytes(nil).Pointer())
+}
+
+func TestPinnedUintptr(t *testing.T) {
+	s := fooBar
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	assert.Equal(t, uintptr(unsafe.Pointer(&s)), pg.Pin(&s).Uintptr())
+	assert.Zero(t, pg.PinBytes(nil).Uintptr())
+}
+
+func TestPinString(t *testing.T) {
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	s := fmt.Sprint(fooBar, 42)
+	var pg ptrguard.Pinner
+	pg.PinString(s).Store(cPtr)
+	assert.Equal(t, s, GoStringNAt(unsafe.Pointer(cPtr), len(s)))
+	assert.Equal(t, 1, pg.Len())
+	pg.PinString("").Store(cPtr)
+	assert.Zero(t, *cPtr)
+	assert.Equal(t, 1, pg.Len())
+	pg.Unpin()
+	assert.Zero(t, *cPtr)
+}
+
+func TestPinAll(t *testing.T) {
+	s := fooBar
+	i := 42
+	b := make([]byte, 8)
+	ptrs := []interface{}{&s, &i, &b[0], unsafe.Pointer(&b[1]), &b}
+	var pg ptrguard.Pinner
+	defer pg.Unpin()
+	pinned := pg.PinAll(ptrs...)
+	if assert.Len(t, pinned, len(ptrs)) {
+		for i := range ptrs {
+			assert.Equal(t, reflect.ValueOf(ptrs[i]).Pointer(),
+				uintptr(pinned[i].Pointer()))
+		}
+	}
+	assert.Equal(t, len(ptrs), pg.Len())
+	assert.Empty(t, pg.PinAll())
+	assert.PanicsWithError(t, "ptrguard: argument 1: int is not a pointer",
+		func() { pg.PinAll(&s, i) })
+	pinned, err := pg.TryPinAll(&s, &i, s)
+	assert.Nil(t, pinned)
+	assert.EqualError(t, err, "ptrguard: argument 2: string is not a pointer")
+	assert.True(t, errors.Is(err, ptrguard.ErrNotAPointer))
+	assert.Equal(t, len(ptrs), pg.Len())
+}
+
+func TestPinValue(t *testing.T) {
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	s := fooBar
+	var pg ptrguard.Pinner
+	pg.PinValue(reflect.ValueOf(&s)).Store(cPtr)
+	assert.Equal(t, unsafe.Pointer(&s), *cPtr)
+	i := 42
+	pinned := pg.PinValue(reflect.ValueOf(unsafe.Pointer(&i)))
+	assert.Equal(t, unsafe.Pointer(&i), pinned.Pointer())
+	assert.Equal(t, 2, pg.Len())
+	assert.PanicsWithError(t, "string is not a pointer",
+		func() { pg.PinValue(reflect.ValueOf(s)) })
+	pinned, err := pg.TryPinValue(reflect.ValueOf(i))
+	assert.Nil(t, pinned)
+	assert.EqualError(t, err, "int is not a pointer")
+	assert.True(t, errors.Is(err, ptrguard.ErrNotAPointer))
+	_, err = pg.TryPinValue(reflect.Value{})
+	assert.EqualError(t, err, "<nil> is not a pointer")
+	assert.Equal(t, 2, pg.Len())
+	pg.Unpin()
+	assert.Zero(t, *cPtr)
+}
+
+func TestStoreAtOffset(t *testing.T) {
+	const offset = 3 * ptrSize
+	cBuf := Malloc(4 * ptrSize)
+	defer Free(cBuf)
+	cPtr := (*unsafe.Pointer)(unsafe.Pointer(uintptr(cBuf) + offset))
+	s := fooBar
+	var pg ptrguard.Pinner
+	pg.Pin(&s).StoreAtOffset(cBuf, offset)
+	assert.Equal(t, unsafe.Pointer(&s), *cPtr)
+	assert.Equal(t, 1, pg.StoredCount())
+	pg.Unpin()
+	assert.Zero(t, *cPtr)
+}
+
+func TestStoreInArray(t *testing.T) {
+	const n = 8
+	for _, elemSize := range []uintptr{ptrSize, SizeOfIovec} {
+		cArr := Malloc(n * elemSize)
+		elem := func(i int) *unsafe.Pointer {
+			return (*unsafe.Pointer)(unsafe.Pointer(uintptr(cArr) + uintptr(i)*elemSize))
+		}
+		for i := 0; i < n; i++ {
+			*elem(i) = nil
+		}
+		s := fooBar
+		var pg ptrguard.Pinner
+		pinned := pg.Pin(&s)
+		for i := 1; i < n; i += 2 {
+			pinned.StoreInArray(cArr, i, elemSize)
+		}
+		for i := 0; i < n; i++ {
+			if i%2 == 1 {
+				assert.Equal(t, unsafe.Pointer(&s), *elem(i), elemSize)
+			} else {
+				assert.Zero(t, *elem(i), elemSize)
+			}
+		}
+		assert.Panics(t, func() { pinned.StoreInArray(cArr, -1, elemSize) })
+		pg.Unpin()
+		for i := 0; i < n; i++ {
+			assert.Zero(t, *elem(i), elemSize)
+		}
+		Free(cArr)
+	}
+}
+
+func TestPinAndStoreSlice(t *testing.T) {
+	const n = 4
+	cIovec := (*[n]goIovec)(Malloc(n * SizeOfIovec))
+	defer Free(unsafe.Pointer(cIovec))
+	*cIovec = [n]goIovec{}
+	buffers := make([]interface{}, n)
+	for i := range buffers {
+		buffers[i] = &[16]byte{}
+	}
+	var pg ptrguard.Pinner
+	pg.PinAndStoreSlice(buffers, unsafe.Pointer(cIovec), SizeOfIovec)
+	for i := range buffers {
+		assert.Equal(t, reflect.ValueOf(buffers[i]).Pointer(),
+			uintptr(cIovec[i].Base), i)
+	}
+	assert.Equal(t, n, pg.Len())
+	assert.Equal(t, n, pg.StoredCount())
+	pg.PinAndStoreSlice(nil, nil, 0)
+	x := 42
+	assert.PanicsWithError(t, "ptrguard: argument 1: int is not a pointer",
+		func() {
+			pg.PinAndStoreSlice([]interface{}{&x, x}, unsafe.Pointer(cIovec), ptrSize)
+		})
+	assert.Panics(t, func() { pg.PinAndStoreSlice(buffers, nil, ptrSize) })
+	assert.Panics(t, func() {
+		pg.PinAndStoreSlice(buffers, unsafe.Pointer(cIovec), ptrSize-1)
+	})
+	assert.Equal(t, n, pg.Len())
+	pg.Unpin()
+	assert.Equal(t, [n]goIovec{}, *cIovec)
+}
+
+func TestCPtrArray(t *testing.T) {
+	const n = 4
+	cArr := (*[n]unsafe.Pointer)(Malloc(n * ptrSize))
+	defer Free(unsafe.Pointer(cArr))
+	*cArr = [n]unsafe.Pointer{}
+	arr := ptrguard.NewCPtrArray(unsafe.Pointer(cArr), n)
+	assert.Equal(t, n, arr.Len())
+	var s [n]string
+	var pg ptrguard.Pinner
+	for i := 0; i < n; i += 2 {
+		arr.Set(i, pg.Pin(&s[i]))
+	}
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			assert.Equal(t, unsafe.Pointer(&s[i]), cArr[i], i)
+		} else {
+			assert.Zero(t, cArr[i], i)
+		}
+	}
+	assert.Equal(t, n/2, pg.StoredCount())
+	pinned := pg.Pin(&s[1])
+	assert.PanicsWithValue(t, "ptrguard: C array index -1 out of range [0:4]",
+		func() { arr.Set(-1, pinned) })
+	assert.PanicsWithValue(t, "ptrguard: C array index 4 out of range [0:4]",
+		func() { arr.Set(n, pinned) })
+	assert.Equal(t, n/2, pg.StoredCount())
+	pg.Unpin()
+	assert.Equal(t, [n]unsafe.Pointer{}, *cArr)
+
+	empty := ptrguard.NewCPtrArray(nil, 0)
+	assert.Equal(t, 0, empty.Len())
+	assert.Panics(t, func() { empty.Set(0, pinned) })
+	assert.Panics(t, func() { ptrguard.NewCPtrArray(nil, 1) })
+	assert.Panics(t, func() { ptrguard.NewCPtrArray(unsafe.Pointer(cArr), -1) })
+	assert.Panics(t, func() {
+		ptrguard.NewCPtrArray(unsafe.Pointer(uintptr(unsafe.Pointer(cArr))+1), 1)
+	})
+}
+
+func TestConcurrentPin(t *testing.T) {
+	const goroutines, pins = 8, 64
+	cPtrArr := (*[goroutines * pins]unsafe.Pointer)(
+		Malloc(ptrSize * goroutines * pins))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	var pg ptrguard.Pinner
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < pins; j++ {
+				pg.Pin(&[1]byte{}).Store(&cPtrArr[i*pins+j])
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, goroutines*pins, pg.Len())
+	assert.Equal(t, goroutines*pins, pg.StoredCount())
+	for i := range cPtrArr {
+		assert.NotZero(t, cPtrArr[i])
+	}
+	pg.Unpin()
+	for i := range cPtrArr {
+		assert.Zero(t, cPtrArr[i])
+	}
+}
+
+func TestConcurrentIterate(t *testing.T) {
+	const goroutines, pins = 4, 64
+	cPtrArr := (*[goroutines * pins]unsafe.Pointer)(
+		Malloc(ptrSize * goroutines * pins))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	cCopy := (*[goroutines * pins]unsafe.Pointer)(
+		Malloc(ptrSize * goroutines * pins))
+	defer Free(unsafe.Pointer(&cCopy[0]))
+	var pg ptrguard.Pinner
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < pins; j++ {
+				pg.Pin(&[1]byte{}).Store(&cPtrArr[i*pins+j])
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < pins; j++ {
+				pg.ForEachPinned(func(unsafe.Pointer) {})
+				pg.RangeTargets(func(_, _ unsafe.Pointer) bool { return true })
+				pg.CopyTargets(unsafe.Pointer(&cCopy[0]), ptrSize)
+				pg.Draining()
+			}
+		}()
+	}
+	wg.Wait()
+	// The callbacks may use the Pinner.
+	n := 0
+	pg.ForEachPinned(func(unsafe.Pointer) {
+		n += pg.Len()
+	})
+	assert.Equal(t, goroutines*pins*goroutines*pins, n)
+	pg.RangeTargets(func(_, _ unsafe.Pointer) bool {
+		return pg.StoredCount() == goroutines*pins
+	})
+	assert.NoError(t, pg.UnpinContext(context.Background()))
+	assert.False(t, pg.Draining())
+}
+
+func TestPinnedUnpin(t *testing.T) {
+	tr1 := newTracer()
+	tr2 := newTracer()
+	cPtrArr := (*[3]unsafe.Pointer)(Malloc(ptrSize * 3))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	var pg ptrguard.Pinner
+	pp1 := pg.Pin(tr1.p)
+	pp2 := pg.Pin(tr2.p)
+	pp1.Store(&cPtrArr[0])
+	pp2.Store(&cPtrArr[1])
+	pp1.Store(&cPtrArr[2])
+	tr1.p = nil
+	tr2.p = nil
+	pp1.Unpin()
+	assert.Zero(t, cPtrArr[0])
+	assert.NotZero(t, cPtrArr[1])
+	assert.Zero(t, cPtrArr[2])
+	assert.Equal(t, 1, pg.Len())
+	assert.Equal(t, 1, pg.StoredCount())
+	pp1.Unpin()
+	assert.Equal(t, 1, pg.Len())
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return tr1.finalized() },
+		5*time.Second, 10*time.Millisecond)
+	assert.False(t, tr2.finalized())
+	pg.Unpin()
+	assert.Zero(t, cPtrArr[1])
+	pp2.Unpin()
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return tr2.finalized() },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestUnpinContext(t *testing.T) {
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	var pg ptrguard.Pinner
+	assert.NoError(t, pg.UnpinContext(context.Background()))
+	pg.Pin(&[1]byte{}).Store(cPtr)
+	assert.NoError(t, pg.UnpinContext(context.Background()))
+	assert.Zero(t, *cPtr)
+	hold := make(chan struct{})
+	pg.Absorb(func() { <-hold })
+	pg.Pin(&[1]byte{}).Store(cPtr)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, pg.UnpinContext(ctx))
+	assert.Zero(t, *cPtr)
+	assert.True(t, pg.Draining())
+	close(hold)
+	assert.Eventually(t, func() bool { return !pg.Draining() },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestAutoUnpin(t *testing.T) {
+	tr := newTracer()
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	var pg ptrguard.Pinner
+	pg.Pin(tr.p).Store(cPtr)
+	tr.p = nil
+	pg.SetAutoUnpin(50 * time.Millisecond)
+	runtime.GC()
+	runtime.GC()
+	assert.False(t, tr.finalized())
+	assert.Equal(t, 1, pg.Len())
+	assert.Eventually(t, func() bool { return pg.Len() == 0 },
+		5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, *cPtr)
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return tr.finalized() },
+		5*time.Second, 10*time.Millisecond)
+	pg.Unpin()
+
+	// After an explicit Unpin() the timer doesn't affect the reused Pinner.
+	pg.Pin(new(int))
+	pg.SetAutoUnpin(10 * time.Millisecond)
+	pg.Unpin()
+	pg.Pin(new(int))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, pg.Len())
+	pg.Unpin()
+}
+
+func TestCgoCheckLevel(t *testing.T) {
+	requireCgoCheck(t)
+	level := ptrguard.CgoCheckLevel()
+	m := regexp.MustCompile(`cgocheck=(\d)`).FindStringSubmatch(os.Getenv("GODEBUG"))
+	switch {
+	case m != nil && (godebugCgoCheckExact || m[1] == "0"):
+		assert.Equal(t, m[1], strconv.Itoa(level))
+	default:
+		assert.NotZero(t, level)
+	}
+	ptrguard.NoCheck(func() {
+		assert.Zero(t, ptrguard.CgoCheckLevel())
+	})
+	assert.Equal(t, level, ptrguard.CgoCheckLevel())
+}
+
+func TestPinBytesLengths(t *testing.T) {
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	for _, buf := range [][]byte{nil, {}, {'x'}, []byte(fooBar)} {
+		var pg ptrguard.Pinner
+		pinned := pg.PinBytes(buf)
+		pinned.Store(cPtr)
+		if len(buf) == 0 {
+			assert.Zero(t, pinned.Pointer())
+			assert.Zero(t, pg.Len())
+		} else {
+			assert.Equal(t, unsafe.Pointer(&buf[0]), pinned.Pointer())
+			assert.Equal(t, 1, pg.Len())
+			assert.Equal(t, string(buf), GoStringNAt(unsafe.Pointer(cPtr), len(buf)))
+		}
+		assert.Equal(t, pinned.Pointer(), *cPtr)
+		assert.Equal(t, len(buf), pg.PinnedBytes())
+		pg.Unpin()
+		assert.Zero(t, *cPtr)
+	}
+}
+
+func TestPinCall(t *testing.T) {
+	tr := newTracer()
+	n := runtime.NumGoroutine()
+	addr := uintptr(unsafe.Pointer(tr.p))
+	called := false
+	ptrguard.PinCall(tr.p, func(p uintptr) {
+		tr.p = nil
+		runtime.GC()
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		assert.False(t, tr.finalized())
+		assert.Equal(t, n, runtime.NumGoroutine())
+		assert.Equal(t, addr, p)
+		called = true
+	})
+	assert.True(t, called)
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return tr.finalized() },
+		5*time.Second, 10*time.Millisecond)
+	assert.Panics(t, func() { ptrguard.PinCall(42, func(uintptr) {}) })
+}
+
+func TestPinNoCheck(t *testing.T) {
+	requireCgoCheck(t)
+	buffer := make([]byte, 8)
+	iovec := make([]Iovec, 1)
+	level := ptrguard.CgoCheckLevel()
+	var pg ptrguard.Pinner
+	pg.PinNoCheck(&buffer[0], func(p uintptr) {
+		assert.Equal(t, uintptr(unsafe.Pointer(&buffer[0])), p)
+		assert.Zero(t, ptrguard.CgoCheckLevel())
+		*(*uintptr)(unsafe.Pointer(&iovec[0].Base)) = p
+		iovec[0].Len = Int(len(buffer))
+		FillBuffersWithX(&iovec[0], len(iovec))
+	})
+	assert.Equal(t, level, ptrguard.CgoCheckLevel())
+	assert.Equal(t, "XXXXXXXX", string(buffer))
+	assert.Equal(t, 1, pg.Len())
+	assert.Panics(t, func() {
+		pg.PinNoCheck(new(int), func(uintptr) { panic("fail") })
+	})
+	assert.Equal(t, level, ptrguard.CgoCheckLevel())
+	assert.Panics(t, func() { pg.PinNoCheck(42, func(uintptr) {}) })
+	assert.Equal(t, 2, pg.Len())
+	pg.Unpin()
+}
+
+func TestWithPinned(t *testing.T) {
+	var buffers [][]byte
+	var ptrs []interface{}
+	for i := 2; i < 12; i += 3 {
+		buffers = append(buffers, make([]byte, i))
+		ptrs = append(ptrs, &buffers[len(buffers)-1][0])
+	}
+	n := len(buffers)
+	cPtr := Malloc(SizeOfIovec * uintptr(n))
+	defer Free(cPtr)
+	iovec := (*[1 << 16]Iovec)(cPtr)[:n:n]
+	called := false
+	ptrguard.WithPinned(ptrs, func() {
+		for i := range iovec {
+			iovec[i].Base = unsafe.Pointer(&buffers[i][0])
+			iovec[i].Len = Int(len(buffers[i]))
+		}
+		FillBuffersWithX(&iovec[0], n)
+		called = true
+	})
+	assert.True(t, called)
+	for i := range buffers {
+		assert.Equal(t, strings.Repeat("X", len(buffers[i])), string(buffers[i]))
+	}
+	assert.PanicsWithError(t, "ptrguard: argument 1: int is not a pointer",
+		func() { ptrguard.WithPinned([]interface{}{ptrs[0], 42}, func() { called = false }) })
+	assert.True(t, called)
+}
+
+func TestMerge(t *testing.T) {
+	tr1 := newTracer()
+	tr2 := newTracer()
+	cPtrArr := (*[2]unsafe.Pointer)(Malloc(ptrSize * 2))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	freed := false
+	var pg1, pg2 ptrguard.Pinner
+	pg1.Pin(tr1.p).Store(&cPtrArr[0])
+	pg2.Pin(tr2.p).Store(&cPtrArr[1])
+	pg2.Absorb(func() { freed = true })
+	tr1.p = nil
+	tr2.p = nil
+	pg1.Merge(&pg2)
+	assert.Equal(t, 2, pg1.Len())
+	assert.Equal(t, 2, pg1.StoredCount())
+	assert.Zero(t, pg2.Len())
+	pg2.Unpin()
+	assert.NotZero(t, cPtrArr[1])
+	assert.False(t, freed)
+	runtime.GC()
+	runtime.GC()
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, tr1.finalized())
+	assert.False(t, tr2.finalized())
+	pg1.Merge(&pg2)
+	pg1.Merge(&ptrguard.Pinner{})
+	pg1.Merge(&pg1)
+	assert.Equal(t, 2, pg1.Len())
+	pg1.Unpin()
+	assert.Zero(t, cPtrArr[0])
+	assert.Zero(t, cPtrArr[1])
+	assert.True(t, freed)
+	runtime.GC()
+	runtime.GC()
+	assert.Eventually(t, func() bool { return tr1.finalized() && tr2.finalized() },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestMergeConcurrent(t *testing.T) {
+	const pins = 64
+	cPtrArr := (*[pins]unsafe.Pointer)(Malloc(ptrSize * pins))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	var pg1, pg2 ptrguard.Pinner
+	pinned := make([]*ptrguard.Pinned, pins)
+	for i := range pinned {
+		pinned[i] = pg2.Pin(&[1]byte{})
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, p := range pinned {
+			p.Store(&cPtrArr[i])
+			_ = p.String()
+			if i%2 == 0 {
+				p.Unpin()
+			}
+		}
+	}()
+	pg1.Merge(&pg2)
+	wg.Wait()
+	assert.Equal(t, pins/2, pg1.Len())
+	assert.Equal(t, pins/2, pg1.StoredCount())
+	pg1.Unpin()
+	for i := range cPtrArr {
+		assert.Zero(t, cPtrArr[i])
+	}
+}
+
+func TestStoreAtomic(t *testing.T) {
+	s := fooBar
+	slot := new(unsafe.Pointer)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if p := atomic.LoadPointer(slot); p != nil {
+				assert.Equal(t, unsafe.Pointer(&s), p)
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		var pg ptrguard.Pinner
+		pg.Pin(&s).StoreAtomic(slot)
+		pg.Unpin()
+	}
+	close(done)
+	wg.Wait()
+	assert.Zero(t, atomic.LoadPointer(slot))
+}
+
+func TestPinnedClear(t *testing.T) {
+	s := fooBar
+	cPtrArr := (*[3]unsafe.Pointer)(Malloc(ptrSize * 3))
+	defer Free(unsafe.Pointer(&cPtrArr[0]))
+	var pg ptrguard.Pinner
+	pp := pg.Pin(&s)
+	pp.Store(&cPtrArr[0])
+	pp.Store(&cPtrArr[1])
+	cPtrArr[2] = nil
+	pp.Clear(&cPtrArr[0])
+	assert.Zero(t, cPtrArr[0])
+	assert.Equal(t, unsafe.Pointer(&s), cPtrArr[1])
+	assert.Equal(t, 1, pg.StoredCount())
+	assert.Equal(t, 1, pg.Len())
+	assert.Panics(t, func() { pp.Clear(&cPtrArr[0]) })
+	assert.Panics(t, func() { pp.Clear(&cPtrArr[2]) })
+	assert.Panics(t, func() { pp.Clear(new(int)) })
+	assert.Panics(t, func() { pg.PinBytes(nil).Clear(&cPtrArr[2]) })
+	cPtrArr[0] = unsafe.Pointer(&s)
+	pg.Unpin()
+	assert.Equal(t, unsafe.Pointer(&s), cPtrArr[0])
+	assert.Zero(t, cPtrArr[1])
+	pp.Clear(&cPtrArr[1])
+}
+
+func TestHooks(t *testing.T) {
+	var pinned []unsafe.Pointer
+	var unpinned []int
+	defer ptrguard.SetOnPin(nil)
+	ptrguard.SetOnPin(func(ptr unsafe.Pointer) {
+		pinned = append(pinned, ptr)
+	})
+	defer ptrguard.SetOnUnpin(nil)
+	ptrguard.SetOnUnpin(func(count int) {
+		unpinned = append(unpinned, count)
+	})
+	var a, b, c int
+	var pg ptrguard.Pinner
+	pg.Pin(&a)
+	pp := pg.Pin(&b)
+	pg.Pin(&c)
+	pg.PinBytes(nil)
+	assert.Equal(t, []unsafe.Pointer{
+		unsafe.Pointer(&a), unsafe.Pointer(&b), unsafe.Pointer(&c),
+	}, pinned)
+	pp.Unpin()
+	assert.Equal(t, []int{1}, unpinned)
+	pg.Unpin()
+	assert.Equal(t, []int{1, 2}, unpinned)
+	pg.Unpin()
+	pp.Unpin()
+	assert.Equal(t, []int{1, 2}, unpinned)
+}
+
+func TestExpvar(t *testing.T) {
+	ptrguard.EnableExpvar()
+	ptrguard.EnableExpvar()
+	// Pins of leaked Pinners of other tests stay active.
+	activePins := func() int {
+		n, err := strconv.Atoi(expvar.Get("ptrguard.active_pins").String())
+		assert.NoError(t, err)
+		return n
+	}
+	base := activePins()
+	var a, b int
+	var pg1, pg2 ptrguard.Pinner
+	pg1.Pin(&a)
+	pp := pg1.Pin(&b)
+	pg2.Pin(&a)
+	assert.Equal(t, base+3, activePins())
+	pp.Unpin()
+	assert.Equal(t, base+2, activePins())
+	pg1.Unpin()
+	assert.Equal(t, base+1, activePins())
+	pg2.Unpin()
+	assert.Equal(t, base, activePins())
+}
+
+func TestPinnedSwap(t *testing.T) {
+	s1, s2 := fooBar, fooBar
+	cPtr := (*unsafe.Pointer)(Malloc(ptrSize))
+	defer Free(unsafe.Pointer(cPtr))
+	*cPtr = nil
+	var pg ptrguard.Pinner
+	assert.Zero(t, pg.Pin(&s1).Swap(cPtr))
+	assert.Equal(t, unsafe.Pointer(&s1), pg.Pin(&s2).Swap(cPtr))
+	assert.Equal(t, unsafe.Pointer(&s2), *cPtr)
+	assert.Equal(t, 2, pg.StoredCount())
+	assert.Panics(t, func() { pg.Pin(&s1).Swap(new(int)) })
+	pg.Unpin()
+	assert.Zero(t, *cPtr)
+}
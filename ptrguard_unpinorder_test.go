@@ -0,0 +1,92 @@
+//go:build cgo
+// +build cgo
+
+package ptrguard // nolint:testpackage
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	. "github.com/ansiwen/ptrguard/internal/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+// releaseRecorder is a keeper, that records when the release of its pins has
+// started.
+type releaseRecorder struct {
+	keeper
+	released *int32
+}
+
+func (r releaseRecorder) release(ptr unsafe.Pointer) {
+	atomic.StoreInt32(r.released, 1)
+	r.keeper.release(ptr)
+}
+
+func (r releaseRecorder) releaseAll() {
+	atomic.StoreInt32(r.released, 1)
+	r.keeper.releaseAll()
+}
+
+// TestUnpinOrder reads a target concurrently to Unpin(), like a C thread, and
+// checks that the pinned pointer is never read anymore, once the object has
+// been released.
+func TestUnpinOrder(t *testing.T) {
+	const cycles = 1000
+	var released int32
+	b := CurrentBackend()
+	newBackendKeeper := newKeeper[b]
+	defer func() { newKeeper[b] = newBackendKeeper }()
+	newKeeper[b] = func() keeper {
+		return releaseRecorder{keeper: newBackendKeeper(), released: &released}
+	}
+	slot := (*unsafe.Pointer)(Malloc(unsafe.Sizeof(uintptr(0))))
+	defer Free(unsafe.Pointer(slot))
+	*slot = nil
+	var violations int32
+	for i := 0; i < cycles; i++ {
+		atomic.StoreInt32(&released, 0)
+		var pg Pinner
+		pinned := pg.Pin(new(int))
+		pinned.StoreAtomic(slot)
+		if i%2 == 1 {
+			// Also with a single pin released by Pinned.Unpin().
+			pg.Pin(new(int))
+		}
+		started := make(chan struct{})
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			close(started)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// The order of the loads matters: once the release has been
+				// observed, the target must be zero already.
+				r := atomic.LoadInt32(&released)
+				v := atomic.LoadUintptr((*uintptr)(unsafe.Pointer(slot)))
+				if r == 1 && v != 0 {
+					atomic.AddInt32(&violations, 1)
+				}
+				runtime.Gosched()
+			}
+		}()
+		<-started
+		if i%2 == 1 {
+			pinned.Unpin()
+		}
+		pg.Unpin()
+		close(stop)
+		wg.Wait()
+		assert.Zero(t, *slot)
+	}
+	assert.Zero(t, atomic.LoadInt32(&violations))
+}
@@ -0,0 +1,80 @@
+// Package ptrguardtest provides helpers for unit testing code that uses
+// ptrguard.
+package ptrguardtest
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+
+	"github.com/ansiwen/ptrguard"
+)
+
+// Poison is the value UnpinAndExpectNoUse() fills the stored slots with. It is
+// an invalid address, so dereferencing it from C crashes detectably.
+const Poison = uintptr(0xdeadbeef)
+
+// FakeCSlot returns a target for the `Store()` method of ptrguard.Pinned, that
+// can be used in unit tests instead of C memory allocated by malloc, and a
+// cleanup function that must be called when the slot is not used anymore.
+//
+// The slot is technically allocated in Go memory, but in a way that it is not
+// scanned by the garbage collector, the same as C memory. It is only intended
+// for testing the storing and zeroing logic of code using ptrguard, and not for
+// real C interop: it must never be passed to C functions.
+func FakeCSlot() (*unsafe.Pointer, func()) {
+	// A uintptr doesn't contain pointers, so the garbage collector ignores
+	// the content of the slot.
+	slot := new(uintptr)
+	return (*unsafe.Pointer)(unsafe.Pointer(slot)), func() {
+		*slot = 0
+	}
+}
+
+// UnpinAndExpectNoUse is a test aid to catch C code that keeps using pinned
+// pointers after they have been unpinned. It unpins p, reports an error if any
+// of the slots the pinned pointers have been stored at has not been zeroed, and
+// then fills all these slots with Poison and forces a garbage collection. A C
+// function that retained a pointer from one of the slots will then crash when
+// it is called again and dereferences it. The slots must be C memory or fake
+// slots from FakeCSlot().
+func UnpinAndExpectNoUse(tb testing.TB, p *ptrguard.Pinner) {
+	tb.Helper()
+	var slots []*uintptr
+	p.RangeTargets(func(slot, _ unsafe.Pointer) bool {
+		slots = append(slots, (*uintptr)(slot))
+		return true
+	})
+	p.Unpin()
+	for _, slot := range slots {
+		if *slot != 0 {
+			tb.Errorf("ptrguardtest: slot %p has not been zeroed by Unpin()", slot)
+		}
+		*slot = Poison
+	}
+	runtime.GC()
+	runtime.GC()
+}
+
+// Main runs the tests like m.Run() with ptrguard.CheckLeaksAtExit() enabled, and
+// reports each Pinner on stderr, that has not been unpinned when all tests have
+// finished. It returns the exit code for os.Exit(), which is 1 in case of leaks,
+// even if all tests have passed. It is meant to be called by TestMain():
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(ptrguardtest.Main(m))
+//	}
+func Main(m *testing.M) int {
+	ptrguard.CheckLeaksAtExit()
+	code := m.Run()
+	leaks := ptrguard.Leaks()
+	for _, err := range leaks {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(leaks) > 0 && code == 0 {
+		code = 1
+	}
+	return code
+}
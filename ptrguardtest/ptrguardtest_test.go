@@ -0,0 +1,42 @@
+package ptrguardtest_test
+
+import (
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/ansiwen/ptrguard"
+	"github.com/ansiwen/ptrguard/ptrguardtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(ptrguardtest.Main(m))
+}
+
+func TestFakeCSlot(t *testing.T) {
+	s := "fooBar"
+	slot, cleanup := ptrguardtest.FakeCSlot()
+	defer cleanup()
+	assert.Zero(t, *slot)
+	var pg ptrguard.Pinner
+	pg.Pin(&s).Store(slot)
+	assert.Equal(t, unsafe.Pointer(&s), *slot)
+	pg.Unpin()
+	assert.Zero(t, *slot)
+}
+
+func TestUnpinAndExpectNoUse(t *testing.T) {
+	s := "fooBar"
+	slot1, cleanup1 := ptrguardtest.FakeCSlot()
+	defer cleanup1()
+	slot2, cleanup2 := ptrguardtest.FakeCSlot()
+	defer cleanup2()
+	var pg ptrguard.Pinner
+	pp := pg.Pin(&s)
+	pp.Store(slot1)
+	pp.Store(slot2)
+	ptrguardtest.UnpinAndExpectNoUse(t, &pg)
+	assert.Equal(t, ptrguardtest.Poison, uintptr(*slot1))
+	assert.Equal(t, ptrguardtest.Poison, uintptr(*slot2))
+}
@@ -0,0 +1,123 @@
+//go:build race
+// +build race
+
+package ptrguard
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// With the race detector enabled, the stores of all Pinners are checked for
+// consistency. Each target is owned by the Pinner, whose pinned pointer has
+// been stored there, until it is zeroed. Storing a pointer of another Pinner at
+// the same target is a misuse, because the target would be zeroed by the
+// `Unpin()` of the first Pinner, while the object of the second one is still
+// expected to be referenced there.
+
+type raceOwner struct {
+	data  *data
+	count int
+}
+
+var (
+	raceMtx     sync.Mutex
+	raceTargets = make(map[*unsafe.Pointer]raceOwner)
+)
+
+// raceAddTarget checks and records that target is owned by d. It panics, if the
+// target is owned by another Pinner.
+func (d *data) raceAddTarget(target *unsafe.Pointer) {
+	raceMtx.Lock()
+	defer raceMtx.Unlock()
+	owner := raceTargets[target]
+	if owner.data != nil && owner.data != d {
+		panic(fmt.Sprintf("ptrguard: target %p is already used by the pinned "+
+			"pointer %p of another Pinner", target, *target))
+	}
+	raceTargets[target] = raceOwner{data: d, count: owner.count + 1}
+}
+
+// casTarget stores ptr at target with an atomic compare-and-swap operation, if
+// it contains old, and records that target is owned by d, if it has been
+// stored. It panics without storing, if the target is owned by another Pinner
+// and would be swapped. Since the registry is locked during the swap, Pinners,
+// that contend for the same target, don't panic.
+func (d *data) casTarget(target *unsafe.Pointer, old, ptr unsafe.Pointer) bool {
+	raceMtx.Lock()
+	defer raceMtx.Unlock()
+	owner := raceTargets[target]
+	if owner.data != nil && owner.data != d {
+		if atomic.LoadUintptr((*uintptr)(unsafe.Pointer(target))) != uintptr(old) {
+			return false
+		}
+		panic(fmt.Sprintf("ptrguard: target %p is already used by the pinned "+
+			"pointer %p of another Pinner", target, *target))
+	}
+	if !atomic.CompareAndSwapUintptr(
+		(*uintptr)(unsafe.Pointer(target)), uintptr(old), uintptr(ptr),
+	) {
+		return false
+	}
+	raceTargets[target] = raceOwner{data: d, count: owner.count + 1}
+	return true
+}
+
+// raceRemoveTarget records that target has been zeroed by d once.
+func (d *data) raceRemoveTarget(target *unsafe.Pointer) {
+	raceMtx.Lock()
+	defer raceMtx.Unlock()
+	owner := raceTargets[target]
+	if owner.data != d {
+		panic(fmt.Sprintf("ptrguard: inconsistent owner of target %p", target))
+	}
+	if owner.count > 1 {
+		raceTargets[target] = raceOwner{data: d, count: owner.count - 1}
+	} else {
+		delete(raceTargets, target)
+	}
+}
+
+// raceReleaseTargets records that all targets of d have been zeroed.
+func (d *data) raceReleaseTargets() {
+	raceMtx.Lock()
+	defer raceMtx.Unlock()
+	for _, target := range d.refs.cPtr {
+		// A target, that has been stored several times, is deleted already.
+		if owner := raceTargets[target]; owner.data != nil && owner.data != d {
+			panic(fmt.Sprintf("ptrguard: inconsistent owner of target %p", target))
+		}
+		delete(raceTargets, target)
+	}
+}
+
+// raceMoveTargets records that all targets of d are owned by dst now.
+func (d *data) raceMoveTargets(dst *data) {
+	raceMtx.Lock()
+	defer raceMtx.Unlock()
+	for _, target := range d.refs.cPtr {
+		owner := raceTargets[target]
+		if owner.data == d {
+			delete(raceTargets, target)
+		}
+		if owner = raceTargets[target]; owner.data != nil && owner.data != dst {
+			panic(fmt.Sprintf("ptrguard: target %p is already used by the "+
+				"pinned pointer %p of another Pinner", target, *target))
+		}
+		raceTargets[target] = raceOwner{data: dst, count: owner.count + 1}
+	}
+}
+
+// raceDropTargets forgets the targets of the leaked d, so that the registry
+// doesn't keep it reachable, and the targets can be used by other Pinners.
+func (d *data) raceDropTargets() {
+	raceMtx.Lock()
+	defer raceMtx.Unlock()
+	for _, target := range d.refs.cPtr {
+		if raceTargets[target].data == d {
+			delete(raceTargets, target)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+//go:build race
+// +build race
+
+package ptrguard_test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/ansiwen/ptrguard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRaceCrossPinnerStore(t *testing.T) {
+	var s1, s2 string
+	target := new(unsafe.Pointer)
+	var pg1, pg2, pg3 ptrguard.Pinner
+	pinned1 := pg1.Pin(&s1)
+	pinned1.Store(target)
+	pinned1.Store(target)
+	pinned2 := pg2.Pin(&s2)
+	assert.Panics(t, func() { pinned2.Store(target) })
+	assert.Equal(t, unsafe.Pointer(&s1), *target)
+	assert.Equal(t, 0, pg2.StoredCount())
+
+	// After a merge the target is owned by the merging Pinner.
+	pg3.Merge(&pg1)
+	assert.Panics(t, func() { pinned2.Store(target) })
+	pg3.Pin(&s1).Store(target)
+	pg3.Unpin()
+	assert.Zero(t, *target)
+
+	// After Unpin() the target can be used by another Pinner.
+	pinned2.Store(target)
+	pinned2.Unpin()
+	assert.Zero(t, *target)
+	pg2.Pin(&s2).Store(target)
+	pg2.Unpin()
+}
+
+func leakStore(target *unsafe.Pointer) {
+	var pg ptrguard.Pinner
+	pg.Pin(new(string)).Store(target)
+}
+
+func TestRaceLeakedTargets(t *testing.T) {
+	leaks := make(chan *ptrguard.LeakError, 1)
+	defer ptrguard.SetLeakHandler(nil)
+	ptrguard.SetLeakHandler(func(err *ptrguard.LeakError) {
+		select {
+		case leaks <- err:
+		default:
+		}
+	})
+	target := new(unsafe.Pointer)
+	leakStore(target)
+	runtime.GC()
+	runtime.GC()
+	select {
+	case <-leaks:
+	case <-time.After(5 * time.Second):
+		t.Fatal("leak has not been detected")
+	}
+	// The target of the leaked Pinner can be used by another Pinner.
+	var pg ptrguard.Pinner
+	assert.NotPanics(t, func() { pg.Pin(new(string)).Store(target) })
+	pg.Unpin()
+	assert.Zero(t, *target)
+}
+
+func TestRaceCrossPinnerStoreCAS(t *testing.T) {
+	var s1, s2 string
+	target := new(unsafe.Pointer)
+	var pg1, pg2 ptrguard.Pinner
+	defer pg2.Unpin()
+	pinned1 := pg1.Pin(&s1)
+	pinned2 := pg2.Pin(&s2)
+	assert.True(t, pinned1.StoreCAS(target, nil))
+	// A contending swap just fails, a swap of the pointer of another Pinner
+	// panics without storing.
+	assert.False(t, pinned2.StoreCAS(target, nil))
+	assert.Panics(t, func() { pinned2.StoreCAS(target, unsafe.Pointer(&s1)) })
+	assert.Equal(t, unsafe.Pointer(&s1), *target)
+	assert.Equal(t, 0, pg2.StoredCount())
+	pg1.Unpin()
+	assert.True(t, pinned2.StoreCAS(target, nil))
+}
@@ -1,20 +1,23 @@
-package ptrguard
-
-import _ "unsafe" // enable go:linkname
+//go:build cgo && !ptrguard_nolinkname
+// +build cgo,!ptrguard_nolinkname
 
-type _dbgVar struct {
-	name  string
-	value *int32
-}
+package ptrguard
 
-//go:linkname _dbgvars runtime.dbgvars
-var _dbgvars []_dbgVar
+import (
+	"fmt"
+	"os"
+)
 
+// cgocheck points to the cgocheck debug variable of the runtime. If it can't be
+// found, e.g. because the runtime has changed, it is nil, which turns NoCheck()
+// into a no-op, and CgoCheckLevel() reports the level as unknown, so that the
+// package can still be used without it.
 var cgocheck = func() *int32 {
-	for i := range _dbgvars {
-		if _dbgvars[i].name == "cgocheck" {
-			return _dbgvars[i].value
-		}
+	if v := lookupDbgVar("cgocheck"); v != nil {
+		return v
 	}
-	panic("Couln't find cgocheck debug variable")
+	fmt.Fprintln(os.Stderr, "ptrguard: Couldn't find the cgocheck debug "+
+		"variable of the runtime. NoCheck() has no effect. Consider the build "+
+		"tag ptrguard_nolinkname.")
+	return nil
 }()
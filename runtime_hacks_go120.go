@@ -0,0 +1,25 @@
+//go:build cgo && !go1.21 && !ptrguard_nolinkname
+// +build cgo,!go1.21,!ptrguard_nolinkname
+
+package ptrguard
+
+import _ "unsafe" // enable go:linkname
+
+type _dbgVar struct {
+	name  string
+	value *int32
+}
+
+//go:linkname _dbgvars runtime.dbgvars
+var _dbgvars []_dbgVar
+
+// lookupDbgVar returns the value of the debug variable name of the runtime, or
+// nil if there is none.
+func lookupDbgVar(name string) *int32 {
+	for i := range _dbgvars {
+		if _dbgvars[i].name == name {
+			return _dbgvars[i].value
+		}
+	}
+	return nil
+}
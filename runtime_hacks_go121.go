@@ -0,0 +1,29 @@
+//go:build cgo && go1.21 && !ptrguard_nolinkname
+// +build cgo,go1.21,!ptrguard_nolinkname
+
+package ptrguard
+
+import "unsafe"
+
+// Since Go 1.21 the debug variables are referenced by pointers, and they can be
+// atomic as well.
+type _dbgVar struct {
+	name   string
+	value  *int32
+	atomic unsafe.Pointer
+	def    int32
+}
+
+//go:linkname _dbgvars runtime.dbgvars
+var _dbgvars []*_dbgVar
+
+// lookupDbgVar returns the value of the non-atomic debug variable name of the
+// runtime, or nil if there is none.
+func lookupDbgVar(name string) *int32 {
+	for _, v := range _dbgvars {
+		if v != nil && v.name == name {
+			return v.value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build cgo && !ptrguard_nolinkname
+// +build cgo,!ptrguard_nolinkname
+
+package ptrguard // nolint:testpackage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupDbgVar(t *testing.T) {
+	assert.NotNil(t, lookupDbgVar("cgocheck"))
+	assert.Equal(t, lookupDbgVar("cgocheck"), cgocheck)
+	assert.Nil(t, lookupDbgVar("ptrguard"))
+}
+
+func TestMissingDbgVar(t *testing.T) {
+	defer func(v *int32) { cgocheck = v }(cgocheck)
+	cgocheck = nil
+	assert.Equal(t, -1, CgoCheckLevel())
+	called := false
+	NoCheck(func() { called = true })
+	assert.True(t, called)
+	assert.False(t, lockCgoCheck())
+	unlockCgoCheck()
+}
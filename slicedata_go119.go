@@ -0,0 +1,13 @@
+//go:build !go1.20
+// +build !go1.20
+
+package ptrguard
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+func stringData(s string) unsafe.Pointer {
+	return unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&s)).Data)
+}
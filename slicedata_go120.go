@@ -0,0 +1,33 @@
+//go:build go1.20
+// +build go1.20
+
+package ptrguard
+
+import "unsafe"
+
+// PinSliceDataPtr pins the backing array of s as returned by unsafe.SliceData()
+// and returns a Pinned value of that pointer. If s has no backing array, i.e. it
+// is nil or has a capacity of zero, there is nothing to pin and a no-op Pinned
+// is returned, that stores nil. Since methods can't have type parameters, the
+// Pinner is passed as the first argument.
+func PinSliceDataPtr[T any](p *Pinner, s []T) *Pinned {
+	ptr := unsafe.SliceData(s)
+	if ptr == nil || cap(s) == 0 {
+		return &Pinned{}
+	}
+	return p.pin(unsafe.Pointer(ptr))
+}
+
+// PinStringDataPtr pins the bytes of s as returned by unsafe.StringData() and
+// returns a Pinned value of that pointer. For an empty string there is nothing to
+// pin and a no-op Pinned is returned, that stores nil.
+func (p *Pinner) PinStringDataPtr(s string) *Pinned {
+	if len(s) == 0 {
+		return &Pinned{}
+	}
+	return p.pin(stringData(s))
+}
+
+func stringData(s string) unsafe.Pointer {
+	return unsafe.Pointer(unsafe.StringData(s))
+}
@@ -0,0 +1,47 @@
+//go:build go1.20 && cgo
+// +build go1.20,cgo
+
+package ptrguard_test
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/ansiwen/ptrguard"
+	C "github.com/ansiwen/ptrguard/internal/testhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinSliceDataPtr(t *testing.T) {
+	cPtr := (*unsafe.Pointer)(C.Malloc(ptrSize))
+	defer C.Free(unsafe.Pointer(cPtr))
+	var pinner ptrguard.Pinner
+	defer pinner.Unpin()
+	s := make([]int, 3)
+	ptrguard.PinSliceDataPtr(&pinner, s).Store(cPtr)
+	assert.Equal(t, unsafe.Pointer(unsafe.SliceData(s)), *cPtr)
+	s = make([]int, 0, 1)
+	ptrguard.PinSliceDataPtr(&pinner, s).Store(cPtr)
+	assert.Equal(t, unsafe.Pointer(unsafe.SliceData(s)), *cPtr)
+	assert.Equal(t, "Pinner{pinned:2, stored:2}", pinner.String())
+	for _, s := range [][]int{nil, {}} {
+		ptrguard.PinSliceDataPtr(&pinner, s).Store(cPtr)
+		assert.Zero(t, *cPtr)
+	}
+	assert.Equal(t, "Pinner{pinned:2, stored:2}", pinner.String())
+}
+
+func TestPinStringDataPtr(t *testing.T) {
+	cPtr := (*unsafe.Pointer)(C.Malloc(ptrSize))
+	defer C.Free(unsafe.Pointer(cPtr))
+	var pinner ptrguard.Pinner
+	defer pinner.Unpin()
+	s := strings.Repeat("foo", 3)
+	pinner.PinStringDataPtr(s).Store(cPtr)
+	assert.Equal(t, unsafe.Pointer(unsafe.StringData(s)), *cPtr)
+	assert.Equal(t, "Pinner{pinned:1, stored:1}", pinner.String())
+	pinner.PinStringDataPtr("").Store(cPtr)
+	assert.Zero(t, *cPtr)
+	assert.Equal(t, "Pinner{pinned:1, stored:1}", pinner.String())
+}
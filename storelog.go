@@ -0,0 +1,70 @@
+package ptrguard
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// StoreRecord describes a store of a pinned pointer, as logged by the store
+// log. The addresses are kept as uintptr, so that the log doesn't keep the
+// objects alive.
+type StoreRecord struct {
+	Slot     uintptr // address of the target
+	Pointer  uintptr // stored pinned pointer
+	CallSite string  // location of the store in the calling code
+}
+
+type ringLog struct {
+	mtx     sync.Mutex
+	records []StoreRecord
+	next    int
+	full    bool
+}
+
+var storeLog *ringLog
+
+// EnableStoreLog enables a log of the last n stores of pinned pointers by any
+// Pinner, that can be retrieved with RecentStores(), e.g. to find out what has
+// been written where when memory corruption is suspected. A value of zero or
+// less disables the log, which is the default. When disabled it has no
+// overhead. It should be called before any Pinner is used.
+func EnableStoreLog(n int) {
+	if n <= 0 {
+		storeLog = nil
+		return
+	}
+	storeLog = &ringLog{records: make([]StoreRecord, n)}
+}
+
+// RecentStores returns the logged stores, starting with the oldest one. It
+// returns nil if the store log is disabled.
+func RecentStores() []StoreRecord {
+	l := storeLog
+	if l == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if !l.full {
+		return append([]StoreRecord(nil), l.records[:l.next]...)
+	}
+	return append(append([]StoreRecord(nil), l.records[l.next:]...),
+		l.records[:l.next]...)
+}
+
+func (l *ringLog) record(target *unsafe.Pointer, ptr unsafe.Pointer) {
+	frame := callSite()
+	l.mtx.Lock()
+	l.records[l.next] = StoreRecord{
+		Slot:     uintptr(unsafe.Pointer(target)),
+		Pointer:  uintptr(ptr),
+		CallSite: fmt.Sprintf("%s:%d", frame.File, frame.Line),
+	}
+	l.next++
+	if l.next == len(l.records) {
+		l.next = 0
+		l.full = true
+	}
+	l.mtx.Unlock()
+}